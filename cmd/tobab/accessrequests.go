@@ -0,0 +1,258 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gnur/tobab"
+	"github.com/lithammer/shortuuid"
+)
+
+const ACCESS_REQUESTS_SHOWN = 10
+
+type deniedVars struct {
+	State string
+	User  *tobab.User
+	CSRF  string
+
+	Host    string
+	Request *tobab.AccessRequest
+}
+
+func (app *Tobab) setAccessRequestRoutes(r *gin.Engine, admin *gin.RouterGroup) {
+
+	r.GET("/denied.html", func(c *gin.Context) {
+		sess := app.getSession(c.GetString("SESSION_ID"))
+		if sess.State != "authenticated" {
+			c.Redirect(http.StatusTemporaryRedirect, "/")
+			return
+		}
+
+		user, err := app.db.GetUser(sess.UserID)
+		if err != nil {
+			app.logger.Error("failed to retrieve user from session", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		host := c.Query("host")
+		if !tobab.Contains(app.getHosts(), host) {
+			app.logger.Warn("invalid hostname provided", "host", host)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		c.HTML(http.StatusForbidden, "denied.html", deniedVars{
+			CSRF:    c.GetString("CSRF_TOKEN"),
+			State:   sess.State,
+			User:    user,
+			Host:    host,
+			Request: app.pendingAccessRequest(user, host),
+		})
+	})
+
+	r.POST("/access/request", func(c *gin.Context) {
+		sess := app.getSession(c.GetString("SESSION_ID"))
+		if sess.State != "authenticated" {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+
+		user, err := app.db.GetUser(sess.UserID)
+		if err != nil {
+			app.logger.Error("failed to retrieve user from session", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		host := c.Query("host")
+		if !tobab.Contains(app.getHosts(), host) {
+			app.logger.Warn("invalid hostname provided", "host", host)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		if app.pendingAccessRequest(user, host) != nil {
+			c.String(200, "You already requested access to "+host+", an admin will review your request.")
+			return
+		}
+
+		req := tobab.AccessRequest{
+			ID:            shortuuid.New(),
+			UserID:        user.ID,
+			UserName:      user.Name,
+			Host:          host,
+			Justification: strings.TrimSpace(c.PostForm("justification")),
+			Status:        tobab.ACCESS_REQUEST_PENDING,
+			Created:       time.Now(),
+		}
+		err = app.db.SetAccessRequest(req)
+		if err != nil {
+			app.logger.Error("failed to store access request", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		app.audit(c, tobab.AuditEvent{
+			Type:   tobab.AUDIT_ACCESS_REQUEST,
+			Actor:  user.Name,
+			Host:   host,
+			Detail: req.Justification,
+		})
+		c.String(200, "Access requested, an admin will review your request.")
+	})
+
+	admin.POST("/access/approve", func(c *gin.Context) {
+		req, err := app.db.GetAccessRequest(c.Query("id"))
+		if err != nil || !req.Pending() {
+			app.logger.Warn("invalid access request provided", "id", c.Query("id"), "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		var notAfter time.Time
+		if expires := c.PostForm("expires"); expires != "" {
+			d, err := time.ParseDuration(expires)
+			if err != nil || d <= 0 {
+				app.logger.Warn("invalid expiry provided", "expires", expires)
+				c.AbortWithStatus(http.StatusBadRequest)
+				return
+			}
+			notAfter = time.Now().Add(d)
+		}
+
+		u, err := app.db.GetUser(req.UserID)
+		if err != nil {
+			app.logger.Warn("user of access request not found", "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		u.GrantAccess(tobab.Grant{Host: req.Host, NotAfter: notAfter})
+		err = app.db.SetUser(*u)
+		if err != nil {
+			app.logger.Warn("Failed to update user", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		app.rotateUserSessions(c, u)
+
+		req.NotAfter = notAfter
+		app.decideAccessRequest(c, req, tobab.ACCESS_REQUEST_APPROVED)
+	})
+
+	admin.POST("/access/deny", func(c *gin.Context) {
+		req, err := app.db.GetAccessRequest(c.Query("id"))
+		if err != nil || !req.Pending() {
+			app.logger.Warn("invalid access request provided", "id", c.Query("id"), "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		app.decideAccessRequest(c, req, tobab.ACCESS_REQUEST_DENIED)
+	})
+}
+
+// decideAccessRequest stores the decision of the admin of the request on req
+func (app *Tobab) decideAccessRequest(c *gin.Context, req *tobab.AccessRequest, status string) {
+	req.Status = status
+	req.DecidedBy = app.sessionUserName(c)
+	req.Decided = time.Now()
+
+	err := app.db.SetAccessRequest(*req)
+	if err != nil {
+		app.logger.Error("failed to store access request", "error", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	detail := status
+	if !req.NotAfter.IsZero() {
+		detail += " until " + req.NotAfter.Format(time.RFC3339)
+	}
+	app.audit(c, tobab.AuditEvent{
+		Type:   tobab.AUDIT_ACCESS_DECISION,
+		Actor:  req.DecidedBy,
+		Target: req.UserName,
+		Host:   req.Host,
+		Detail: detail,
+	})
+
+	c.Header("HX-Refresh", "true")
+	c.JSON(200, gin.H{})
+}
+
+// denyForwardAuth tells an authenticated user they can not access host, browsers are sent to the denied page and api clients and nginx get a 403
+func (app *Tobab) denyForwardAuth(c *gin.Context, user *tobab.User, host string) {
+	c.Set("VERIFY_RESULT", VERIFY_DENY)
+
+	if wantsJSON(c) || nginxMode(c) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+			"msg":  "you do not have access to " + host,
+			"host": host,
+			"user": user.Name,
+		})
+		return
+	}
+
+	denied := app.fqdn + "/denied.html?host=" + url.QueryEscape(host)
+	c.Header("HX-Redirect", denied)
+	c.Redirect(http.StatusTemporaryRedirect, denied)
+}
+
+// wantsJSON reports whether the original request came from htmx or asked for a JSON response
+func wantsJSON(c *gin.Context) bool {
+	return acceptsJSON(c.Request.Header)
+}
+
+// acceptsJSON reports whether a request with headers h came from htmx or asked for a JSON response
+func acceptsJSON(h http.Header) bool {
+	return h.Get("HX-Request") == "true" || strings.Contains(h.Get("Accept"), "application/json")
+}
+
+// pendingAccessRequest returns the request of user for host that has not been decided on yet, or nil
+func (app *Tobab) pendingAccessRequest(user *tobab.User, host string) *tobab.AccessRequest {
+	for _, r := range app.userAccessRequests(user) {
+		if r.Host == host && r.Pending() {
+			return &r
+		}
+	}
+	return nil
+}
+
+// userAccessRequests returns the requests of user, newest first
+func (app *Tobab) userAccessRequests(user *tobab.User) []tobab.AccessRequest {
+	requests, err := app.db.GetAccessRequestsByUser(user.ID)
+	if err != nil {
+		app.logger.Error("failed to retrieve access requests", "error", err)
+		return nil
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		return requests[i].Created.After(requests[j].Created)
+	})
+	return requests
+}
+
+// pendingAccessRequests returns the requests admins still have to decide on, oldest first
+func (app *Tobab) pendingAccessRequests() []tobab.AccessRequest {
+	requests, err := app.db.GetAccessRequests()
+	if err != nil {
+		app.logger.Error("failed to retrieve access requests", "error", err)
+		return nil
+	}
+
+	pending := []tobab.AccessRequest{}
+	for _, r := range requests {
+		if r.Pending() {
+			pending = append(pending, r)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].Created.Before(pending[j].Created)
+	})
+	return pending
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gnur/tobab"
+	"github.com/lithammer/shortuuid"
+)
+
+// API_KEY_PREFIX makes tobab keys recognizable, bearer tokens without it are left alone so upstreams can use their own
+const API_KEY_PREFIX = "tobab_"
+
+type apiKeyVars struct {
+	State string
+	User  *tobab.User
+	CSRF  string
+
+	Keys   []tobab.APIKey
+	Hosts  []string
+	NewKey string
+}
+
+func (app *Tobab) setAPIKeyRoutes(r *gin.Engine) {
+	keys := r.Group("/apikeys")
+	keys.Use(app.authenticatedMiddleware())
+
+	keys.GET("/index.html", func(c *gin.Context) {
+		app.renderAPIKeys(c, "")
+	})
+
+	keys.POST("/create", func(c *gin.Context) {
+		sess := app.getSession(c.GetString("SESSION_ID"))
+		user, err := app.db.GetUser(sess.UserID)
+		if err != nil {
+			app.logger.Error("failed to retrieve user from session", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		name := strings.TrimSpace(c.PostForm("name"))
+		if name == "" {
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		var expires time.Time
+		if exp := c.PostForm("expires"); exp != "" {
+			d, err := time.ParseDuration(exp)
+			if err != nil || d <= 0 {
+				app.logger.Warn("invalid expiry provided", "expires", exp)
+				c.AbortWithStatus(http.StatusBadRequest)
+				return
+			}
+			expires = time.Now().Add(d)
+		}
+
+		hosts := c.PostFormArray("hosts")
+		for _, h := range hosts {
+			if !app.canAccess(user, h) {
+				app.logger.Warn("user tried to scope api key to inaccessible host", "user", user.Name, "host", h)
+				c.AbortWithStatus(http.StatusBadRequest)
+				return
+			}
+		}
+
+		key, err := generateAPIKey()
+		if err != nil {
+			app.logger.Error("failed to generate api key", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		err = app.db.SetAPIKey(tobab.APIKey{
+			ID:      shortuuid.New(),
+			UserID:  user.ID,
+			Name:    name,
+			Hash:    tobab.HashSecret(key),
+			Created: time.Now(),
+			Expires: expires,
+			Hosts:   hosts,
+		})
+		if err != nil {
+			app.logger.Error("failed to save api key", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		app.logger.Info("created api key", "user", user.Name, "name", name)
+		app.renderAPIKeys(c, key)
+	})
+
+	keys.POST("/revoke", func(c *gin.Context) {
+		id := c.Query("id")
+
+		sess := app.getSession(c.GetString("SESSION_ID"))
+		user, err := app.db.GetUser(sess.UserID)
+		if err != nil {
+			app.logger.Error("failed to retrieve user from session", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		userKeys, err := app.db.GetAPIKeys(user.ID)
+		if err != nil {
+			app.logger.Error("failed to retrieve api keys", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		found := false
+		for _, k := range userKeys {
+			if k.ID == id {
+				found = true
+				break
+			}
+		}
+		if !found {
+			app.logger.Warn("invalid api key provided", "user", user.Name, "id", id)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		err = app.db.DeleteAPIKey(id)
+		if err != nil {
+			app.logger.Error("failed to delete api key", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		app.logger.Info("revoked api key", "user", user.Name, "id", id)
+		c.Header("HX-Refresh", "true")
+		c.JSON(200, gin.H{})
+	})
+}
+
+func (app *Tobab) renderAPIKeys(c *gin.Context, newKey string) {
+	sess := app.getSession(c.GetString("SESSION_ID"))
+	user, err := app.db.GetUser(sess.UserID)
+	if err != nil {
+		app.logger.Error("failed to retrieve user from session", "error", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	keys, err := app.db.GetAPIKeys(user.ID)
+	if err != nil {
+		app.logger.Error("failed to retrieve api keys", "error", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	var hosts []string
+	for _, h := range app.getHosts() {
+		if app.canAccess(user, h) {
+			hosts = append(hosts, h)
+		}
+	}
+
+	c.HTML(200, "apikeys.html", apiKeyVars{
+		CSRF:   c.GetString("CSRF_TOKEN"),
+		State:  sess.State,
+		User:   user,
+		Keys:   keys,
+		Hosts:  hosts,
+		NewKey: newKey,
+	})
+}
+
+func generateAPIKey() (string, error) {
+	s, err := randomString(32)
+	if err != nil {
+		return "", err
+	}
+	return API_KEY_PREFIX + s, nil
+}
+
+// apiKeyFromRequest returns the tobab API key from the Authorization header if one is present
+func apiKeyFromRequest(c *gin.Context) (string, bool) {
+	return apiKeyFromHeader(c.GetHeader("Authorization"))
+}
+
+// apiKeyFromHeader returns the tobab API key from the value of an Authorization header
+func apiKeyFromHeader(authorization string) (string, bool) {
+	key, ok := strings.CutPrefix(authorization, "Bearer ")
+	if !ok || !strings.HasPrefix(key, API_KEY_PREFIX) {
+		return "", false
+	}
+	return key, true
+}
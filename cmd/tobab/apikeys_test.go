@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gnur/tobab"
+)
+
+var apiKeyCode = regexp.MustCompile(`<pre><code>(tobab_[^<]+)</code></pre>`)
+
+func TestAPIKeys(t *testing.T) {
+	app, srv := newTestServer(t)
+
+	for _, h := range []string{"secure.example.com", "other.example.com"} {
+		if err := app.db.SetHost(tobab.Host{Name: h, Policy: tobab.HOST_POLICY_PRIVATE}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	alice := tobab.User{ID: []byte("alice"), Name: "alice", AccessibleHosts: []string{"secure.example.com", "other.example.com"}}
+	mallory := tobab.User{ID: []byte("mallory"), Name: "mallory", AccessibleHosts: []string{"secure.example.com"}, Disabled: true}
+	for _, u := range []tobab.User{alice, mallory} {
+		if err := app.db.SetUser(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//the key is shown once when it is created, only its hash is stored
+	b := newBrowser(t, srv.URL)
+	sess := b.login(app, alice)
+	form := url.Values{"name": {"ci"}, "hosts": {"secure.example.com"}, CSRF_FIELD: {sess.Vals["csrf"]}}
+	res, body := b.do("POST", "/apikeys/create", strings.NewReader(form.Encode()), http.Header{
+		"Content-Type": {"application/x-www-form-urlencoded"},
+	})
+	m := apiKeyCode.FindStringSubmatch(body)
+	if res.StatusCode != http.StatusOK || m == nil {
+		t.Fatalf("create api key: got %d without a key on the page", res.StatusCode)
+	}
+	scoped := m[1]
+	if k, err := app.db.GetAPIKeyByHash(tobab.HashSecret(scoped)); err != nil || k.Name != "ci" {
+		t.Fatalf("created api key is not stored by its hash: %v", err)
+	}
+
+	//a key can't be scoped to hosts its owner can't access
+	form.Set("hosts", "unknown.example.com")
+	if res, _ := b.do("POST", "/apikeys/create", strings.NewReader(form.Encode()), http.Header{
+		"Content-Type": {"application/x-www-form-urlencoded"},
+	}); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("create api key for inaccessible host: got %d, want 400", res.StatusCode)
+	}
+
+	keys := map[string]tobab.APIKey{
+		"tobab_full":    {ID: "full", UserID: alice.ID, Name: "full"},
+		"tobab_expired": {ID: "expired", UserID: alice.ID, Name: "expired", Expires: time.Now().Add(-time.Minute)},
+		"tobab_mallory": {ID: "mallory", UserID: mallory.ID, Name: "mallory"},
+	}
+	for key, k := range keys {
+		k.Hash = tobab.HashSecret(key)
+		k.Created = time.Now()
+		if err := app.db.SetAPIKey(k); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		auth   string
+		host   string
+		want   int
+		wantID string
+	}{
+		{"key of user", "Bearer tobab_full", "other.example.com", http.StatusOK, "alice"},
+		{"scoped key on its host", "Bearer " + scoped, "secure.example.com", http.StatusOK, "alice"},
+		{"scoped key on other host", "Bearer " + scoped, "other.example.com", http.StatusForbidden, ""},
+		{"expired key", "Bearer tobab_expired", "secure.example.com", http.StatusUnauthorized, ""},
+		{"unknown key", "Bearer tobab_unknown", "secure.example.com", http.StatusUnauthorized, ""},
+		{"key of disabled user", "Bearer tobab_mallory", "secure.example.com", http.StatusUnauthorized, ""},
+		{"bearer token of the upstream", "Bearer upstream-token", "secure.example.com", http.StatusTemporaryRedirect, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newBrowser(t, srv.URL)
+			res, _ := client.do("GET", "/verify", nil, http.Header{
+				"X-Forwarded-Host": {tt.host},
+				"X-Forwarded-Uri":  {"/"},
+				"Authorization":    {tt.auth},
+			})
+			if res.StatusCode != tt.want {
+				t.Errorf("verify: got %d, want %d", res.StatusCode, tt.want)
+			}
+			if got := res.Header.Get("X-Tobab-User"); got != tt.wantID {
+				t.Errorf("X-Tobab-User = %q, want %q", got, tt.wantID)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gnur/tobab"
+	"github.com/lithammer/shortuuid"
+)
+
+const AUDIT_PAGE_SIZE = 200
+
+type auditVars struct {
+	State string
+	User  tobab.User
+	CSRF  string
+
+	Events []tobab.AuditEvent
+	Types  []string
+	Hosts  []string
+	Filter tobab.AuditFilter
+	Window string
+}
+
+func (app *Tobab) setAuditRoutes(admin *gin.RouterGroup) {
+
+	admin.GET("/audit.html", func(c *gin.Context) {
+		sess := app.getSession(c.GetString("SESSION_ID"))
+		user, err := app.db.GetUser(sess.UserID)
+		if err != nil {
+			app.logger.Error("failed to retrieve user from session", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		filter := tobab.AuditFilter{
+			Type:  c.Query("type"),
+			User:  c.Query("user"),
+			Host:  c.Query("host"),
+			Limit: AUDIT_PAGE_SIZE,
+		}
+		if window := c.Query("window"); window != "" {
+			d, err := time.ParseDuration(window)
+			if err != nil {
+				app.logger.Warn("invalid window provided", "window", window)
+				c.AbortWithStatus(http.StatusBadRequest)
+				return
+			}
+			filter.Since = time.Now().Add(-d)
+		}
+
+		events, err := app.db.GetAuditEvents(filter)
+		if err != nil {
+			app.logger.Error("failed to retrieve audit events", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		c.HTML(200, "audit.html", auditVars{
+			CSRF:   c.GetString("CSRF_TOKEN"),
+			State:  sess.State,
+			User:   *user,
+			Events: events,
+			Types:  tobab.AuditTypes,
+			Hosts:  app.getHosts(),
+			Filter: filter,
+			Window: c.Query("window"),
+		})
+	})
+}
+
+// audit records e in the database and, when configured, as a JSON line in the audit log, c is nil for events outside of a request
+func (app *Tobab) audit(c *gin.Context, e tobab.AuditEvent) {
+	e.ID = shortuuid.New()
+	e.Time = time.Now()
+	if c != nil {
+		e.IP = c.ClientIP()
+	}
+
+	app.logger.Info("audit", "type", e.Type, "actor", e.Actor, "target", e.Target, "host", e.Host, "ip", e.IP, "detail", e.Detail)
+
+	err := app.db.AddAuditEvent(e)
+	if err != nil {
+		app.logger.Error("failed to store audit event", "error", err, "type", e.Type)
+	}
+
+	if app.auditLog == nil {
+		return
+	}
+	app.auditMu.Lock()
+	defer app.auditMu.Unlock()
+	err = json.NewEncoder(app.auditLog).Encode(e)
+	if err != nil {
+		app.logger.Error("failed to write audit event", "error", err, "type", e.Type)
+	}
+}
+
+// sessionUserName returns the name of the user that is logged in with the session of the request
+func (app *Tobab) sessionUserName(c *gin.Context) string {
+	sess := app.getSession(c.GetString("SESSION_ID"))
+	if sess.State != "authenticated" {
+		return ""
+	}
+	user, err := app.db.GetUser(sess.UserID)
+	if err != nil {
+		return ""
+	}
+	return user.Name
+}
+
+func grantDetail(granted bool) string {
+	if granted {
+		return "granted"
+	}
+	return "revoked"
+}
+
+// openAuditLog opens the file audit events are streamed to, stdout or - stream to standard output and an empty path disables streaming
+func openAuditLog(path string) (io.Writer, error) {
+	switch path {
+	case "":
+		return nil, nil
+	case "stdout", "-":
+		return os.Stdout, nil
+	default:
+		return os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	}
+}
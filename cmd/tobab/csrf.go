@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gnur/tobab"
+)
+
+const (
+	CSRF_HEADER = "X-CSRF-Token"
+	CSRF_FIELD  = "csrf_token"
+)
+
+// csrfExempt are the mutating routes that are called by other servers instead of browsers, they don't use the session cookie
+var csrfExempt = map[string]bool{
+	"/oidc/token":    true,
+	"/oidc/userinfo": true,
+}
+
+// renewCSRFToken gives s a new CSRF token, the old one stops working
+func renewCSRFToken(s *tobab.Session) error {
+	token, err := randomString(32)
+	if err != nil {
+		return err
+	}
+	s.Vals["csrf"] = token
+	return nil
+}
+
+// csrfMiddleware rejects state changing requests that come from another site or don't carry the CSRF token of the session.
+// The cookie is shared with every subdomain of the cookie scope, so any of them could otherwise send requests as the user.
+func (app *Tobab) csrfMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			return
+		}
+		if csrfExempt[c.Request.URL.Path] || extAuthzPath(c.Request.URL.Path) {
+			return
+		}
+		if _, ok := apiKeyFromRequest(c); ok {
+			return
+		}
+
+		ll := app.logger.With("method", "csrf", "path", c.Request.URL.Path, "ip", c.ClientIP())
+
+		if site := c.GetHeader("Sec-Fetch-Site"); site != "" && site != "same-origin" && site != "none" {
+			ll.Warn("rejecting cross site request", "sec_fetch_site", site)
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"msg": "cross site request rejected",
+			})
+			return
+		}
+
+		if origin := c.GetHeader("Origin"); origin != "" && !app.sameOrigin(origin) {
+			ll.Warn("rejecting request from other origin", "origin", origin)
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"msg": "cross site request rejected",
+			})
+			return
+		}
+
+		want := c.GetString("CSRF_TOKEN")
+		got := c.GetHeader(CSRF_HEADER)
+		if got == "" {
+			got = c.PostForm(CSRF_FIELD)
+		}
+		if want == "" || subtle.ConstantTimeCompare([]byte(got), []byte(want)) != 1 {
+			ll.Warn("rejecting request without valid csrf token")
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"msg": "invalid csrf token, reload the page and try again",
+			})
+			return
+		}
+	}
+}
+
+// sameOrigin reports whether origin is tobab itself
+func (app *Tobab) sameOrigin(origin string) bool {
+	o, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	self, err := url.Parse(app.fqdn)
+	if err != nil {
+		return false
+	}
+	return o.Scheme == self.Scheme && o.Host == self.Host
+}
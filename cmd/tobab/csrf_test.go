@@ -0,0 +1,256 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gnur/tobab"
+)
+
+var csrfMeta = regexp.MustCompile(`<meta name="csrf-token" content="([^"]*)">`)
+
+// browser keeps the session cookie of tobab between requests, like a browser on the cookie scope would
+type browser struct {
+	t      *testing.T
+	base   string
+	client *http.Client
+	cookie *http.Cookie
+}
+
+func newBrowser(t *testing.T, base string) *browser {
+	return &browser{
+		t:    t,
+		base: base,
+		client: &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}},
+	}
+}
+
+func (b *browser) do(method, path string, body io.Reader, header http.Header) (*http.Response, string) {
+	b.t.Helper()
+	req, err := http.NewRequest(method, b.base+path, body)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if b.cookie != nil {
+		req.AddCookie(b.cookie)
+	}
+	res, err := b.client.Do(req)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	defer res.Body.Close()
+	raw, err := io.ReadAll(res.Body)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	for _, c := range res.Cookies() {
+		if c.Name == COOKIE_NAME {
+			b.cookie = c
+		}
+	}
+	return res, string(raw)
+}
+
+// login gives b an authenticated session of user, the passkey login itself needs a browser
+func (b *browser) login(app *Tobab, user tobab.User) *tobab.Session {
+	b.t.Helper()
+	sess := app.getSession("")
+	sess.UserID = user.ID
+	sess.FSM = setupFSM("authenticated")
+	if err := app.db.SetSession(*sess); err != nil {
+		b.t.Fatal(err)
+	}
+	b.cookie = &http.Cookie{Name: COOKIE_NAME, Value: sess.ID}
+	return sess
+}
+
+// csrfToken loads page and returns the token from its csrf-token meta tag
+func (b *browser) csrfToken(page string) string {
+	b.t.Helper()
+	res, body := b.do("GET", page, nil, nil)
+	if res.StatusCode != http.StatusOK {
+		b.t.Fatalf("GET %s: got %d, want 200", page, res.StatusCode)
+	}
+	m := csrfMeta.FindStringSubmatch(body)
+	if m == nil || m[1] == "" {
+		b.t.Fatalf("GET %s: page has no csrf token", page)
+	}
+	return m[1]
+}
+
+func TestRegisterCSRF(t *testing.T) {
+	app, srv := newTestServer(t)
+	b := newBrowser(t, srv.URL)
+
+	token := b.csrfToken("/register.html")
+
+	res, _ := b.do("POST", "/passkey/register/start", strings.NewReader(`{"Name": "alice"}`), http.Header{
+		"Content-Type": {"application/json"},
+		CSRF_HEADER:    {token},
+	})
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("register start with the token of the register page: got %d, want 200", res.StatusCode)
+	}
+
+	bob := tobab.User{ID: []byte("bob"), Name: "bob"}
+	if err := app.db.SetUser(bob); err != nil {
+		t.Fatal(err)
+	}
+	err := app.storeRecoveryLink(tobab.HashSecret("recover-bob"), recoveryLink{UserID: bob.ID, Expires: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b = newBrowser(t, srv.URL)
+	token = b.csrfToken("/register.html?recovery=recover-bob")
+	res, _ = b.do("POST", "/passkey/recover/start", strings.NewReader(`{"Token": "recover-bob"}`), http.Header{
+		"Content-Type": {"application/json"},
+		CSRF_HEADER:    {token},
+	})
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("recover start with the token of the register page: got %d, want 200", res.StatusCode)
+	}
+}
+
+func TestCSRFMiddleware(t *testing.T) {
+	_, srv := newTestServer(t)
+	const register = "/passkey/register/start"
+
+	tests := []struct {
+		name   string
+		header func(token string) http.Header
+		form   bool
+		want   int
+	}{
+		{
+			name:   "no token",
+			header: func(string) http.Header { return http.Header{} },
+			want:   http.StatusForbidden,
+		},
+		{
+			name:   "token of another session",
+			header: func(string) http.Header { return http.Header{CSRF_HEADER: {"not-the-token"}} },
+			want:   http.StatusForbidden,
+		},
+		{
+			name:   "token in header",
+			header: func(token string) http.Header { return http.Header{CSRF_HEADER: {token}} },
+			want:   http.StatusOK,
+		},
+		{
+			name:   "token in form field",
+			header: func(string) http.Header { return http.Header{} },
+			form:   true,
+			want:   http.StatusBadRequest, //passes the csrf check, the form is no valid registration
+		},
+		{
+			name: "cross site request with token",
+			header: func(token string) http.Header {
+				return http.Header{CSRF_HEADER: {token}, "Sec-Fetch-Site": {"same-site"}}
+			},
+			want: http.StatusForbidden,
+		},
+		{
+			name: "other origin with token",
+			header: func(token string) http.Header {
+				return http.Header{CSRF_HEADER: {token}, "Origin": {"https://evil.example.com"}}
+			},
+			want: http.StatusForbidden,
+		},
+		{
+			name: "own origin with token",
+			header: func(token string) http.Header {
+				return http.Header{CSRF_HEADER: {token}, "Origin": {"https://login.example.com"}, "Sec-Fetch-Site": {"same-origin"}}
+			},
+			want: http.StatusOK,
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newBrowser(t, srv.URL)
+			token := b.csrfToken("/register.html")
+
+			//every registration needs a name that is not taken yet
+			header := tt.header(token)
+			body := io.Reader(strings.NewReader(`{"Name": "user` + strconv.Itoa(i) + `"}`))
+			header.Set("Content-Type", "application/json")
+			if tt.form {
+				body = strings.NewReader(url.Values{CSRF_FIELD: {token}}.Encode())
+				header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+
+			res, _ := b.do("POST", register, body, header)
+			if res.StatusCode != tt.want {
+				t.Errorf("got %d, want %d", res.StatusCode, tt.want)
+			}
+		})
+	}
+
+	//servers calling the token endpoint have no session
+	b := newBrowser(t, srv.URL)
+	res, _ := b.do("POST", "/oidc/token", strings.NewReader("grant_type=authorization_code"), http.Header{
+		"Content-Type": {"application/x-www-form-urlencoded"},
+	})
+	if res.StatusCode == http.StatusForbidden {
+		t.Errorf("oidc token endpoint was rejected as csrf")
+	}
+}
+
+func TestSignoutCSRF(t *testing.T) {
+	app, srv := newTestServer(t)
+	alice := tobab.User{ID: []byte("alice"), Name: "alice"}
+	if err := app.db.SetUser(alice); err != nil {
+		t.Fatal(err)
+	}
+
+	loggedIn := func(id string) bool {
+		s, err := app.db.GetSession(id)
+		return err == nil && s.Expires.After(time.Now())
+	}
+	form := func(token string) (io.Reader, http.Header) {
+		return strings.NewReader(url.Values{CSRF_FIELD: {token}}.Encode()), http.Header{"Content-Type": {"application/x-www-form-urlencoded"}}
+	}
+
+	for _, path := range []string{"/signout", "/register"} {
+		t.Run(path, func(t *testing.T) {
+			b := newBrowser(t, srv.URL)
+			sess := b.login(app, alice)
+			token := b.csrfToken("/")
+
+			b.do("GET", path, nil, nil)
+			if !loggedIn(sess.ID) {
+				t.Fatalf("GET %s ended the session", path)
+			}
+
+			body, header := form("not-the-token")
+			res, _ := b.do("POST", path, body, header)
+			if res.StatusCode != http.StatusForbidden {
+				t.Errorf("POST %s without the token: got %d, want 403", path, res.StatusCode)
+			}
+			if !loggedIn(sess.ID) {
+				t.Fatalf("POST %s without the token ended the session", path)
+			}
+
+			body, header = form(token)
+			res, _ = b.do("POST", path, body, header)
+			if res.StatusCode != http.StatusSeeOther {
+				t.Errorf("POST %s: got %d, want 303", path, res.StatusCode)
+			}
+			if loggedIn(sess.ID) {
+				t.Errorf("POST %s kept the session", path)
+			}
+		})
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"github.com/gin-gonic/gin"
+	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+)
+
+// EXT_AUTHZ_PREFIX is the path_prefix envoy puts in front of the original path when it uses the HTTP ext_authz service
+const (
+	EXT_AUTHZ_PREFIX = "/ext_authz"
+	EXT_AUTHZ_ROUTE  = EXT_AUTHZ_PREFIX + "/*path"
+)
+
+// extAuthzPath reports whether path is asked about by envoy, those requests are not tobab's own and get no session or csrf check
+func extAuthzPath(path string) bool {
+	return path == EXT_AUTHZ_PREFIX || strings.HasPrefix(path, EXT_AUTHZ_PREFIX+"/")
+}
+
+func (app *Tobab) setExtAuthzRoutes(r *gin.Engine) {
+	//envoy sends the method, host and headers of the original request, with the original path after the prefix
+	r.Any(EXT_AUTHZ_ROUTE, func(c *gin.Context) {
+		if !app.fromTrustedProxy(c) {
+			app.logger.Warn("Return 403 to untrusted source", "service", "ext_authz", "remote", c.RemoteIP())
+			c.Set("VERIFY_RESULT", VERIFY_DENY)
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+
+		req := extAuthzRequest(c.Request.Host, c.Param("path"), c.Request.Method, c.Request.Header)
+		req.IP = c.ClientIP()
+		if c.Request.URL.RawQuery != "" {
+			req.URI += "?" + c.Request.URL.RawQuery
+		}
+		c.Set("VERIFY_HOST", req.Host)
+
+		d := app.decide(req)
+		c.Set("VERIFY_RESULT", d.Result)
+
+		status, headers := app.extAuthzResponse(req, d, acceptsJSON(c.Request.Header))
+		for k := range headers {
+			c.Header(k, headers.Get(k))
+		}
+		c.AbortWithStatus(status)
+	})
+}
+
+// extAuthzRequest builds the verifyRequest for the original request envoy asks about
+func extAuthzRequest(host, uri, method string, h http.Header) verifyRequest {
+	req := verifyRequest{
+		Host:   host,
+		Proto:  h.Get("X-Forwarded-Proto"),
+		URI:    uri,
+		Method: method,
+	}
+	if req.Proto == "" {
+		req.Proto = "https"
+	}
+	if req.URI == "" {
+		req.URI = "/"
+	}
+	if cookie, err := (&http.Request{Header: h}).Cookie(COOKIE_NAME); err == nil {
+		req.SessionID = cookie.Value
+	}
+	req.APIKey, _ = apiKeyFromHeader(h.Get("Authorization"))
+	return req
+}
+
+// extAuthzResponse turns d into the status and headers envoy should act on, they are the same for the HTTP and gRPC service.
+// envoy passes the response of a denied check to the browser, so unauthenticated users are redirected to the login page
+// with the page they wanted, and denied users to the denied page. htmx and JSON clients get the status code instead.
+func (app *Tobab) extAuthzResponse(req verifyRequest, d verifyDecision, json bool) (int, http.Header) {
+	switch {
+	case d.Result == VERIFY_ALLOW:
+		return http.StatusOK, d.Headers
+
+	case d.Result == VERIFY_REDIRECT && !json:
+		login := app.fqdn + "/?rd=" + url.QueryEscape(req.OriginalURL())
+		return http.StatusFound, http.Header{"Location": {login}}
+
+	case d.AskAccess && !json:
+		denied := app.fqdn + "/denied.html?host=" + url.QueryEscape(req.Host)
+		return http.StatusFound, http.Header{"Location": {denied}}
+	}
+	return d.Status, nil
+}
+
+// extAuthzServer is the gRPC flavour of envoy's external authorization, used by istio and envoy gateway
+type extAuthzServer struct {
+	app *Tobab
+}
+
+func (s *extAuthzServer) Check(ctx context.Context, r *authv3.CheckRequest) (*authv3.CheckResponse, error) {
+	start := time.Now()
+	app := s.app
+
+	var remote string
+	if p, ok := peer.FromContext(ctx); ok {
+		remote, _, _ = net.SplitHostPort(p.Addr.String())
+	}
+	if !app.trustedProxy(remote) {
+		app.logger.Warn("Return 403 to untrusted source", "service", "ext_authz", "remote", remote)
+		app.observeVerify("", VERIFY_DENY, start)
+		return extAuthzCheckResponse(http.StatusForbidden, nil), nil
+	}
+
+	attrs := r.GetAttributes()
+	httpReq := attrs.GetRequest().GetHttp()
+
+	//envoy sends the headers lowercased, canonicalize them so they can be read like any other request
+	h := http.Header{}
+	for k, v := range httpReq.GetHeaders() {
+		h.Set(k, v)
+	}
+	if h.Get("X-Forwarded-Proto") == "" && httpReq.GetScheme() != "" {
+		h.Set("X-Forwarded-Proto", httpReq.GetScheme())
+	}
+
+	req := extAuthzRequest(httpReq.GetHost(), httpReq.GetPath(), httpReq.GetMethod(), h)
+	req.IP = attrs.GetSource().GetAddress().GetSocketAddress().GetAddress()
+
+	d := app.decide(req)
+	app.observeVerify(req.Host, d.Result, start)
+
+	status, headers := app.extAuthzResponse(req, d, acceptsJSON(h))
+	return extAuthzCheckResponse(status, headers), nil
+}
+
+// extAuthzCheckResponse is the CheckResponse for a HTTP status, headers go to the upstream on a 200 and to the client otherwise
+func extAuthzCheckResponse(status int, headers http.Header) *authv3.CheckResponse {
+	var options []*corev3.HeaderValueOption
+	for k := range headers {
+		options = append(options, &corev3.HeaderValueOption{
+			Header: &corev3.HeaderValue{Key: k, Value: headers.Get(k)},
+		})
+	}
+
+	if status == http.StatusOK {
+		return &authv3.CheckResponse{
+			Status: &rpcstatus.Status{Code: int32(codes.OK)},
+			HttpResponse: &authv3.CheckResponse_OkResponse{
+				OkResponse: &authv3.OkHttpResponse{Headers: options},
+			},
+		}
+	}
+
+	code := codes.PermissionDenied
+	switch {
+	case status == http.StatusUnauthorized:
+		code = codes.Unauthenticated
+	case status >= 500:
+		code = codes.Unavailable
+	}
+	return &authv3.CheckResponse{
+		Status: &rpcstatus.Status{Code: int32(code)},
+		HttpResponse: &authv3.CheckResponse_DeniedResponse{
+			DeniedResponse: &authv3.DeniedHttpResponse{
+				Status:  &typev3.HttpStatus{Code: typev3.StatusCode(status)},
+				Headers: options,
+			},
+		},
+	}
+}
+
+// startExtAuthzServer serves envoy's gRPC external authorization API on its own address
+func (app *Tobab) startExtAuthzServer(addr string) {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		app.logger.Error("Failed to start ext_authz server", "error", err)
+		return
+	}
+
+	srv := grpc.NewServer()
+	authv3.RegisterAuthorizationServer(srv, &extAuthzServer{app: app})
+
+	app.logger.Info("starting ext_authz server", "address", addr)
+	err = srv.Serve(lis)
+	if err != nil {
+		app.logger.Error("Failed to start ext_authz server", "error", err)
+	}
+}
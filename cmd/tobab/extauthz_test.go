@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"github.com/gnur/tobab"
+	"google.golang.org/grpc/codes"
+)
+
+func TestExtAuthz(t *testing.T) {
+	app, srv := newTestServer(t)
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	for _, h := range []string{"secure.example.com", "other.example.com"} {
+		if err := app.db.SetHost(tobab.Host{Name: h, Policy: tobab.HOST_POLICY_PRIVATE}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	alice := tobab.User{ID: []byte("alice"), Name: "alice", AccessibleHosts: []string{"secure.example.com"}}
+	if err := app.db.SetUser(alice); err != nil {
+		t.Fatal(err)
+	}
+	sess := tobab.Session{
+		ID:       "alice-session",
+		UserID:   alice.ID,
+		Created:  time.Now(),
+		LastSeen: time.Now(),
+		Expires:  time.Now().Add(time.Hour),
+		Vals:     map[string]string{},
+		FSM:      setupFSM("authenticated"),
+	}
+	if err := app.db.SetSession(sess); err != nil {
+		t.Fatal(err)
+	}
+	cookie := COOKIE_NAME + "=" + sess.ID
+
+	//envoy's HTTP service: original method, host and headers, the original path after the prefix
+	check := func(method, host, path string, header http.Header) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, srv.URL+EXT_AUTHZ_PREFIX+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = host
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	login := app.fqdn + "/?rd=" + url.QueryEscape("https://secure.example.com/app/?tab=a")
+	res := check("GET", "secure.example.com", "/app/?tab=a", nil)
+	if res.StatusCode != http.StatusFound || res.Header.Get("Location") != login {
+		t.Errorf("http check without session: got %d to %q, want 302 to %q", res.StatusCode, res.Header.Get("Location"), login)
+	}
+	if len(res.Cookies()) != 0 {
+		t.Errorf("http check set a cookie for the checked host: %v", res.Cookies())
+	}
+
+	res = check("GET", "secure.example.com", "/app/", http.Header{"Accept": {"application/json"}})
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("http check without session for json client: got %d, want 401", res.StatusCode)
+	}
+
+	//requests to the upstream carry no csrf token of tobab
+	res = check("POST", "secure.example.com", "/app/save", http.Header{"Cookie": {cookie}})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("http check for granted host: got %d, want 200", res.StatusCode)
+	}
+	if got := res.Header.Get("X-Tobab-User"); got != "alice" {
+		t.Errorf("X-Tobab-User = %q, want alice", got)
+	}
+	if res.Header.Get("X-Tobab-Token") == "" {
+		t.Errorf("http check response has no identity token")
+	}
+
+	res = check("GET", "other.example.com", "/", http.Header{"Cookie": {cookie}})
+	if res.StatusCode != http.StatusFound || res.Header.Get("Location") != app.fqdn+"/denied.html?host=other.example.com" {
+		t.Errorf("http check for host without access: got %d to %q, want 302 to the denied page", res.StatusCode, res.Header.Get("Location"))
+	}
+
+	//envoy's gRPC service sends the same request as a CheckRequest
+	grpcCheck := func(host, path string, headers map[string]string) *authv3.CheckResponse {
+		t.Helper()
+		res, err := (&extAuthzServer{app: app}).Check(context.Background(), &authv3.CheckRequest{
+			Attributes: &authv3.AttributeContext{
+				Request: &authv3.AttributeContext_Request{
+					Http: &authv3.AttributeContext_HttpRequest{
+						Method:  "GET",
+						Host:    host,
+						Path:    path,
+						Scheme:  "https",
+						Headers: headers,
+					},
+				},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	cr := grpcCheck("secure.example.com", "/app/?tab=a", nil)
+	denied := cr.GetDeniedResponse()
+	if cr.GetStatus().GetCode() != int32(codes.PermissionDenied) || denied.GetStatus().GetCode() != http.StatusFound {
+		t.Fatalf("grpc check without session: got %v, want a 302 denied response", cr)
+	}
+	if h := denied.GetHeaders(); len(h) != 1 || h[0].GetHeader().GetValue() != login {
+		t.Errorf("grpc check without session redirects to %v, want %q", h, login)
+	}
+
+	cr = grpcCheck("secure.example.com", "/app/", map[string]string{"cookie": cookie})
+	if cr.GetStatus().GetCode() != int32(codes.OK) || cr.GetOkResponse() == nil {
+		t.Fatalf("grpc check for granted host: got %v, want ok", cr)
+	}
+	headers := map[string]string{}
+	for _, h := range cr.GetOkResponse().GetHeaders() {
+		headers[h.GetHeader().GetKey()] = h.GetHeader().GetValue()
+	}
+	if headers["X-Tobab-User"] != "alice" || headers["X-Tobab-Token"] == "" {
+		t.Errorf("grpc check has identity headers %v, want user alice and a token", headers)
+	}
+
+	cr = grpcCheck("other.example.com", "/", map[string]string{"cookie": cookie, "accept": "application/json"})
+	if cr.GetDeniedResponse().GetStatus().GetCode() != http.StatusForbidden {
+		t.Errorf("grpc check for host without access: got %v, want 403", cr)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gnur/tobab"
+)
+
+const GRANT_TIME_LAYOUT = "2006-01-02T15:04"
+
+func (app *Tobab) setGrantRoutes(admin *gin.RouterGroup) {
+
+	admin.POST("/grant", func(c *gin.Context) {
+		u, err := app.db.GetUserByName(c.Query("user"))
+		if err != nil {
+			app.logger.Warn("invalid username provided", "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		g := tobab.Grant{
+			Host: c.PostForm("host"),
+		}
+		if !tobab.Contains(app.getHosts(), g.Host) {
+			app.logger.Warn("invalid hostname provided", "host", g.Host)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		g.NotBefore, err = parseGrantTime(c.PostForm("notbefore"))
+		if err != nil {
+			app.logger.Warn("invalid start time provided", "notbefore", c.PostForm("notbefore"))
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		g.NotAfter, err = parseGrantTime(c.PostForm("notafter"))
+		if err != nil {
+			app.logger.Warn("invalid end time provided", "notafter", c.PostForm("notafter"))
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		if !g.NotAfter.IsZero() && (g.NotAfter.Before(time.Now()) || g.NotAfter.Before(g.NotBefore)) {
+			app.logger.Warn("grant ends before it starts", "notbefore", g.NotBefore, "notafter", g.NotAfter)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		u.GrantAccess(g)
+		err = app.db.SetUser(*u)
+		if err != nil {
+			app.logger.Warn("Failed to update user", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		app.rotateUserSessions(c, u)
+
+		app.audit(c, tobab.AuditEvent{
+			Type:   tobab.AUDIT_TOGGLE_ACCESS,
+			Actor:  app.sessionUserName(c),
+			Target: u.Name,
+			Host:   g.Host,
+			Detail: grantPeriod(g),
+		})
+
+		c.Header("HX-Refresh", "true")
+		c.JSON(200, gin.H{})
+	})
+}
+
+// pruneGrants removes the grants that have ended from every user and returns how many were removed
+func (app *Tobab) pruneGrants() (int, error) {
+	users, err := app.db.GetUsers()
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, u := range users {
+		if len(u.PruneGrants()) == 0 {
+			continue
+		}
+
+		//an admin or a login may have changed the user since the list was read, only the grants are ours to change.
+		//GetUser would mark the user as seen, the prune job is not the user
+		fresh, err := app.db.GetUserByName(u.Name)
+		if err == tobab.ErrNotFound || (err == nil && string(fresh.ID) != string(u.ID)) {
+			continue
+		}
+		if err != nil {
+			return n, err
+		}
+		u = *fresh
+		expired := u.PruneGrants()
+		if len(expired) == 0 {
+			continue
+		}
+		err = app.db.SetUser(u)
+		if err != nil {
+			return n, err
+		}
+		for _, g := range expired {
+			app.audit(nil, tobab.AuditEvent{
+				Type:   tobab.AUDIT_GRANT_EXPIRED,
+				Actor:  "tobab",
+				Target: u.Name,
+				Host:   g.Host,
+				Detail: "ended " + g.NotAfter.Format(time.RFC3339),
+			})
+		}
+		n += len(expired)
+	}
+	return n, nil
+}
+
+// parseGrantTime parses the value of a datetime-local input in the local timezone, an empty value is no bound
+func parseGrantTime(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	return time.ParseInLocation(GRANT_TIME_LAYOUT, v, time.Local)
+}
+
+func grantPeriod(g tobab.Grant) string {
+	detail := "granted"
+	if !g.NotBefore.IsZero() {
+		detail += " from " + g.NotBefore.Format(time.RFC3339)
+	}
+	if !g.NotAfter.IsZero() {
+		detail += " until " + g.NotAfter.Format(time.RFC3339)
+	}
+	return detail
+}
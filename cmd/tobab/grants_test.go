@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gnur/tobab"
+)
+
+// staleUsersDB returns the users as they were when it was created, like a list read just before an admin changed them
+type staleUsersDB struct {
+	tobab.Database
+	users []tobab.User
+	saved []string
+}
+
+func (db *staleUsersDB) GetUsers() ([]tobab.User, error) {
+	return db.users, nil
+}
+
+func (db *staleUsersDB) SetUser(u tobab.User) error {
+	db.saved = append(db.saved, u.Name)
+	return db.Database.SetUser(u)
+}
+
+func TestPruneGrants(t *testing.T) {
+	app, _ := newTestServer(t)
+
+	ended := time.Now().Add(-time.Minute)
+	users := []tobab.User{
+		{ID: []byte("alice"), Name: "alice", Grants: []tobab.Grant{
+			{Host: "old.example.com", NotAfter: ended},
+			{Host: "secure.example.com", NotAfter: time.Now().Add(time.Hour)},
+		}},
+		{ID: []byte("bob"), Name: "bob", Grants: []tobab.Grant{{Host: "secure.example.com"}}},
+	}
+	for _, u := range users {
+		if err := app.db.SetUser(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db := &staleUsersDB{Database: app.db, users: users}
+	app.db = db
+
+	//alice was made admin after the list was read
+	alice := users[0]
+	alice.Admin = true
+	if err := db.Database.SetUser(alice); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := app.pruneGrants()
+	if err != nil || n != 1 {
+		t.Fatalf("pruneGrants() = %d, %v, want 1 expired grant", n, err)
+	}
+	if len(db.saved) != 1 || db.saved[0] != "alice" {
+		t.Errorf("pruneGrants saved %v, want only alice", db.saved)
+	}
+
+	got, err := app.db.GetUserByName(alice.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Admin {
+		t.Errorf("pruneGrants undid a change made after the users were read")
+	}
+	if !got.LastSeen.IsZero() {
+		t.Errorf("pruneGrants marked alice as seen at %s", got.LastSeen)
+	}
+	if bob, _ := app.db.GetUserByName("bob"); !bob.LastSeen.IsZero() {
+		t.Errorf("pruneGrants marked bob as seen at %s", bob.LastSeen)
+	}
+	if len(got.Grants) != 1 || got.Grants[0].Host != "secure.example.com" {
+		t.Errorf("alice has grants %+v, want only secure.example.com", got.Grants)
+	}
+
+	if n, _ := app.pruneGrants(); n != 0 {
+		t.Errorf("second pruneGrants removed %d grants, want 0", n)
+	}
+}
+
+func TestGrantPeriodVerify(t *testing.T) {
+	app, srv := newTestServer(t)
+
+	if err := app.db.SetHost(tobab.Host{Name: "secure.example.com", Policy: tobab.HOST_POLICY_PRIVATE}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		grant tobab.Grant
+		want  int
+	}{
+		{"open ended", tobab.Grant{Host: "secure.example.com"}, http.StatusOK},
+		{"within period", tobab.Grant{Host: "secure.example.com", NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour)}, http.StatusOK},
+		{"not started", tobab.Grant{Host: "secure.example.com", NotBefore: time.Now().Add(time.Hour)}, http.StatusForbidden},
+		{"ended, not pruned yet", tobab.Grant{Host: "secure.example.com", NotAfter: time.Now().Add(-time.Minute)}, http.StatusForbidden},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := tobab.User{ID: []byte("user" + strconv.Itoa(i)), Name: "user" + strconv.Itoa(i), Grants: []tobab.Grant{tt.grant}}
+			if err := app.db.SetUser(u); err != nil {
+				t.Fatal(err)
+			}
+			b := newBrowser(t, srv.URL)
+			b.login(app, u)
+
+			res, _ := b.do("GET", "/verify", nil, http.Header{
+				"X-Forwarded-Host": {"secure.example.com"},
+				"X-Forwarded-Uri":  {"/"},
+				"Accept":           {"application/json"},
+			})
+			if res.StatusCode != tt.want {
+				t.Errorf("verify: got %d, want %d", res.StatusCode, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gnur/tobab"
+	"github.com/lithammer/shortuuid"
+)
+
+type groupVars struct {
+	State string
+	User  tobab.User
+	CSRF  string
+
+	Users  []tobab.User
+	Hosts  []string
+	Groups []tobab.Group
+}
+
+func (app *Tobab) setGroupRoutes(admin *gin.RouterGroup) {
+
+	admin.GET("/groups.html", func(c *gin.Context) {
+		users, err := app.db.GetUsers()
+		if err != nil {
+			app.logger.Error("failed to retrieve users from database", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		sess := app.getSession(c.GetString("SESSION_ID"))
+		user, err := app.db.GetUser(sess.UserID)
+		if err != nil {
+			app.logger.Error("failed to retrieve user from session", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		c.HTML(200, "groups.html", groupVars{
+			CSRF:   c.GetString("CSRF_TOKEN"),
+			State:  sess.State,
+			User:   *user,
+			Users:  users,
+			Hosts:  app.getHosts(),
+			Groups: app.getGroups(),
+		})
+	})
+
+	admin.POST("/groups/create", func(c *gin.Context) {
+		name := strings.TrimSpace(c.PostForm("name"))
+		if name == "" {
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		err := app.db.SetGroup(tobab.Group{
+			ID:          shortuuid.New(),
+			Name:        name,
+			Description: strings.TrimSpace(c.PostForm("description")),
+			Created:     time.Now(),
+		})
+		if err != nil {
+			app.logger.Warn("Failed to create group", "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		c.Redirect(http.StatusSeeOther, "/admin/groups.html")
+	})
+
+	admin.POST("/groups/delete", func(c *gin.Context) {
+		id := c.Query("group")
+
+		err := app.db.DeleteGroup(id)
+		if err == tobab.ErrNotFound {
+			app.logger.Warn("invalid group provided", "group", id)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			app.logger.Error("failed to delete group", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		users, err := app.db.GetUsers()
+		if err != nil {
+			app.logger.Error("failed to retrieve users from database", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		for _, u := range users {
+			if !tobab.Contains(u.Groups, id) {
+				continue
+			}
+			u.Groups = remove(u.Groups, id)
+			err = app.db.SetUser(u)
+			if err != nil {
+				app.logger.Warn("Failed to update user", "error", err)
+			}
+		}
+
+		c.Header("HX-Refresh", "true")
+		c.JSON(200, gin.H{})
+	})
+
+	admin.POST("/groups/toggleAccess", func(c *gin.Context) {
+		hostName := c.Query("host")
+
+		g, err := app.db.GetGroup(c.Query("group"))
+		if err != nil {
+			app.logger.Warn("invalid group provided", "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		if !tobab.Contains(app.getHosts(), hostName) {
+			app.logger.Warn("invalid hostname provided")
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		granted := !tobab.Contains(g.AccessibleHosts, hostName)
+		if granted {
+			g.AccessibleHosts = append(g.AccessibleHosts, hostName)
+		} else {
+			g.AccessibleHosts = remove(g.AccessibleHosts, hostName)
+		}
+
+		err = app.db.SetGroup(*g)
+		if err != nil {
+			app.logger.Warn("Failed to update group", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		if granted {
+			app.rotateGroupSessions(c, g)
+		}
+
+		app.audit(c, tobab.AuditEvent{
+			Type:   tobab.AUDIT_GROUP_ACCESS,
+			Actor:  app.sessionUserName(c),
+			Target: g.Name,
+			Host:   hostName,
+			Detail: grantDetail(granted),
+		})
+
+		c.JSON(200, gin.H{})
+	})
+
+	admin.POST("/groups/toggleMember", func(c *gin.Context) {
+		g, err := app.db.GetGroup(c.Query("group"))
+		if err != nil {
+			app.logger.Warn("invalid group provided", "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		u, err := app.db.GetUserByName(c.Query("user"))
+		if err != nil {
+			app.logger.Warn("invalid username provided", "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		joined := !u.MemberOf(*g)
+		if joined {
+			u.Groups = append(u.Groups, g.ID)
+		} else {
+			u.Groups = remove(u.Groups, g.ID)
+		}
+
+		err = app.db.SetUser(*u)
+		if err != nil {
+			app.logger.Warn("Failed to update user", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		if joined {
+			app.rotateUserSessions(c, u)
+		}
+
+		detail := "added to " + g.Name
+		if !joined {
+			detail = "removed from " + g.Name
+		}
+		app.audit(c, tobab.AuditEvent{
+			Type:   tobab.AUDIT_GROUP_MEMBER,
+			Actor:  app.sessionUserName(c),
+			Target: u.Name,
+			Detail: detail,
+		})
+
+		c.JSON(200, gin.H{})
+	})
+}
+
+func (app *Tobab) getGroups() []tobab.Group {
+	groups, err := app.db.GetGroups()
+	if err != nil {
+		app.logger.Error("Failed to get groups", "error", err)
+	}
+	return groups
+}
+
+// userGroups returns the groups user is a member of
+func (app *Tobab) userGroups(user *tobab.User) []tobab.Group {
+	var groups []tobab.Group
+	for _, g := range app.getGroups() {
+		if user.MemberOf(g) {
+			groups = append(groups, g)
+		}
+	}
+	return groups
+}
+
+// canAccess resolves the direct and group grants of user for host h, and the default policy of h
+func (app *Tobab) canAccess(user *tobab.User, h string) bool {
+	if user.CanAccess(h, app.userGroups(user)...) {
+		return true
+	}
+	return app.hostPolicy(h) != tobab.HOST_POLICY_PRIVATE
+}
+
+// identityHeaders exposes the identity of user to the upstream for host on a successful forward auth response
+func (app *Tobab) identityHeaders(user *tobab.User, host string) http.Header {
+	names := []string{}
+	for _, g := range app.userGroups(user) {
+		names = append(names, g.Name)
+	}
+
+	h := http.Header{}
+	h.Set("X-Tobab-User", user.Name)
+	h.Set("X-Tobab-Groups", strings.Join(names, ","))
+
+	token, err := app.signIdentityToken(user, names, host)
+	if err != nil {
+		app.logger.Error("failed to sign identity token", "error", err)
+		return h
+	}
+	h.Set(app.jwtHeader, token)
+	return h
+}
+
+func remove(s []string, e string) []string {
+	var res []string
+	for _, a := range s {
+		if a != e {
+			res = append(res, a)
+		}
+	}
+	return res
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gnur/tobab"
+)
+
+// HOSTS_KEY held the list of host names before hosts were stored as records
+const HOSTS_KEY = "hosts"
+
+// MAX_PENDING_HOSTS is the number of pending hosts after which new hosts are no longer discovered,
+// pending hosts that were not seen for PENDING_HOST_MAX_AGE are dropped
+const (
+	MAX_PENDING_HOSTS    = 100
+	PENDING_HOST_MAX_AGE = 7 * 24 * time.Hour
+)
+
+type hostVars struct {
+	State string
+	User  tobab.User
+	CSRF  string
+
+	Hosts    []tobab.Host
+	Users    []tobab.User
+	Policies []string
+}
+
+func (app *Tobab) setHostRoutes(admin *gin.RouterGroup) {
+
+	admin.GET("/hosts.html", func(c *gin.Context) {
+		hosts, err := app.db.GetHosts()
+		if err != nil {
+			app.logger.Error("failed to retrieve hosts from database", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		sort.Slice(hosts, func(i, j int) bool {
+			if hosts[i].Pending != hosts[j].Pending {
+				return hosts[i].Pending
+			}
+			return hosts[i].Name < hosts[j].Name
+		})
+
+		users, err := app.db.GetUsers()
+		if err != nil {
+			app.logger.Error("failed to retrieve users from database", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		sess := app.getSession(c.GetString("SESSION_ID"))
+		user, err := app.db.GetUser(sess.UserID)
+		if err != nil {
+			app.logger.Error("failed to retrieve user from session", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		c.HTML(200, "hosts.html", hostVars{
+			CSRF:     c.GetString("CSRF_TOKEN"),
+			State:    sess.State,
+			User:     *user,
+			Hosts:    hosts,
+			Users:    users,
+			Policies: tobab.HostPolicies,
+		})
+	})
+
+	admin.POST("/hosts/save", func(c *gin.Context) {
+		name := strings.ToLower(strings.TrimSpace(c.PostForm("name")))
+		if name == "" || strings.ContainsAny(name, "/ ") {
+			app.logger.Warn("invalid hostname provided", "host", name)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		policy := c.DefaultPostForm("policy", tobab.HOST_POLICY_PRIVATE)
+		if !tobab.Contains(tobab.HostPolicies, policy) {
+			app.logger.Warn("invalid policy provided", "policy", policy)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		h, err := app.db.GetHost(name)
+		if err == tobab.ErrNotFound {
+			h = &tobab.Host{
+				Name:    name,
+				Created: time.Now(),
+			}
+		} else if err != nil {
+			app.logger.Error("failed to retrieve host", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		h.DisplayName = strings.TrimSpace(c.PostForm("displayname"))
+		h.Description = strings.TrimSpace(c.PostForm("description"))
+		h.IconURL = strings.TrimSpace(c.PostForm("icon"))
+		h.Owner = c.PostForm("owner")
+		h.Policy = policy
+		h.Pending = false
+
+		err = app.db.SetHost(*h)
+		if err != nil {
+			app.logger.Error("failed to save host", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		app.audit(c, tobab.AuditEvent{
+			Type:   tobab.AUDIT_HOST_CHANGED,
+			Actor:  app.sessionUserName(c),
+			Host:   h.Name,
+			Detail: "saved with policy " + h.Policy,
+		})
+		c.Redirect(http.StatusSeeOther, "/admin/hosts.html")
+	})
+
+	admin.POST("/hosts/accept", func(c *gin.Context) {
+		h, err := app.db.GetHost(c.Query("host"))
+		if err != nil {
+			app.logger.Warn("invalid hostname provided", "host", c.Query("host"), "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		h.Pending = false
+		err = app.db.SetHost(*h)
+		if err != nil {
+			app.logger.Error("failed to save host", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		app.audit(c, tobab.AuditEvent{
+			Type:   tobab.AUDIT_HOST_CHANGED,
+			Actor:  app.sessionUserName(c),
+			Host:   h.Name,
+			Detail: "accepted",
+		})
+		c.Header("HX-Refresh", "true")
+		c.JSON(200, gin.H{})
+	})
+
+	admin.POST("/hosts/delete", func(c *gin.Context) {
+		name := c.Query("host")
+
+		err := app.db.DeleteHost(name)
+		if err == tobab.ErrNotFound {
+			app.logger.Warn("invalid hostname provided", "host", name)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			app.logger.Error("failed to delete host", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		//a host that is discovered again later should not come back with the access it had before
+		users, err := app.db.GetUsers()
+		if err != nil {
+			app.logger.Error("failed to retrieve users from database", "error", err)
+		}
+		//grants that haven't started yet count too, CanAccess doesn't see them
+		for _, u := range users {
+			if !tobab.Contains(u.AccessibleHosts, name) && u.Grant(name) == nil {
+				continue
+			}
+			u.RevokeAccess(name)
+			err = app.db.SetUser(u)
+			if err != nil {
+				app.logger.Warn("Failed to update user", "error", err)
+			}
+		}
+		for _, g := range app.getGroups() {
+			if !tobab.Contains(g.AccessibleHosts, name) {
+				continue
+			}
+			g.AccessibleHosts = remove(g.AccessibleHosts, name)
+			err = app.db.SetGroup(g)
+			if err != nil {
+				app.logger.Warn("Failed to update group", "error", err)
+			}
+		}
+
+		app.audit(c, tobab.AuditEvent{
+			Type:   tobab.AUDIT_HOST_CHANGED,
+			Actor:  app.sessionUserName(c),
+			Host:   name,
+			Detail: "deleted",
+		})
+		c.Header("HX-Refresh", "true")
+		c.JSON(200, gin.H{})
+	})
+}
+
+// getHosts returns the names of the hosts an admin accepted
+func (app *Tobab) getHosts() []string {
+	hosts, err := app.db.GetHosts()
+	if err != nil {
+		app.logger.Error("Failed to get hosts", "error", err)
+	}
+
+	var names []string
+	for _, h := range hosts {
+		if !h.Pending {
+			names = append(names, h.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// getHost returns the accepted host h, or nil when it is unknown or pending
+func (app *Tobab) getHost(h string) *tobab.Host {
+	host, err := app.db.GetHost(h)
+	if err != nil {
+		if err != tobab.ErrNotFound {
+			app.logger.Error("Failed to get host", "error", err)
+		}
+		return nil
+	}
+	if host.Pending {
+		return nil
+	}
+	return host
+}
+
+// hostPolicy returns the default policy of h, unknown and pending hosts are private
+func (app *Tobab) hostPolicy(h string) string {
+	host := app.getHost(h)
+	if host == nil || host.Policy == "" {
+		return tobab.HOST_POLICY_PRIVATE
+	}
+	return host.Policy
+}
+
+// addHost makes sure h is a known host, accepting it when it was pending
+func (app *Tobab) addHost(h string) {
+	host, err := app.db.GetHost(h)
+	if err == nil && !host.Pending {
+		return
+	}
+	if err != nil {
+		host = &tobab.Host{
+			Name:    h,
+			Policy:  tobab.HOST_POLICY_PRIVATE,
+			Created: time.Now(),
+		}
+	}
+	host.Pending = false
+
+	err = app.db.SetHost(*host)
+	if err != nil {
+		app.logger.Error("Failed to set host", "error", err)
+	}
+}
+
+// discoverHost records that h was seen through forward auth, unknown hosts under the cookie scope are stored as pending.
+// Only requests of trusted proxies may get here, the host is set by the client.
+func (app *Tobab) discoverHost(h string) {
+	if h == "" {
+		return
+	}
+
+	host, err := app.db.GetHost(h)
+	if err == tobab.ErrNotFound {
+		name := h
+		if hostname, _, err := net.SplitHostPort(h); err == nil {
+			name = hostname
+		}
+		//the session cookie doesn't reach hosts outside the scope, so tobab can't protect them
+		if !app.inCookieScope(name) {
+			return
+		}
+		if app.pendingHosts() >= MAX_PENDING_HOSTS {
+			app.logger.Warn("Not discovering host, too many pending hosts", "host", h)
+			return
+		}
+		app.logger.Info("discovered new host", "host", h)
+		host = &tobab.Host{
+			Name:    h,
+			Policy:  tobab.HOST_POLICY_PRIVATE,
+			Pending: true,
+			Created: time.Now(),
+		}
+	} else if err != nil {
+		app.logger.Error("Failed to get host", "error", err)
+		return
+	} else if time.Since(host.LastSeen) < time.Minute {
+		return
+	}
+	host.LastSeen = time.Now()
+
+	err = app.db.SetHost(*host)
+	if err != nil {
+		app.logger.Error("Failed to set host", "error", err)
+	}
+}
+
+// pendingHosts returns the number of hosts waiting to be accepted
+func (app *Tobab) pendingHosts() int {
+	hosts, err := app.db.GetHosts()
+	if err != nil {
+		app.logger.Error("Failed to get hosts", "error", err)
+	}
+
+	n := 0
+	for _, h := range hosts {
+		if h.Pending {
+			n++
+		}
+	}
+	return n
+}
+
+// cleanPendingHosts deletes the pending hosts that were not seen for PENDING_HOST_MAX_AGE
+func (app *Tobab) cleanPendingHosts() (int, error) {
+	hosts, err := app.db.GetHosts()
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, h := range hosts {
+		if !h.Pending || time.Since(h.LastSeen) < PENDING_HOST_MAX_AGE {
+			continue
+		}
+		err = app.db.DeleteHost(h.Name)
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// migrateHosts turns the host names stored by older versions into accepted host records
+func (app *Tobab) migrateHosts() {
+	var names []string
+	err := app.db.KVGet(HOSTS_KEY, &names)
+	if err != nil || len(names) == 0 {
+		return
+	}
+
+	for _, h := range names {
+		app.addHost(h)
+	}
+	err = app.db.KVSet(HOSTS_KEY, []string{})
+	if err != nil {
+		app.logger.Error("Failed to clear old hosts", "error", err)
+		return
+	}
+	app.logger.Info("migrated hosts", "hosts", len(names))
+}
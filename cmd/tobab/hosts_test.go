@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gnur/tobab"
+)
+
+func TestDiscoverHost(t *testing.T) {
+	app, srv := newTestServer(t)
+	b := newBrowser(t, srv.URL)
+
+	verify := func(host string) {
+		t.Helper()
+		b.do("GET", "/verify", nil, http.Header{"X-Forwarded-Host": {host}, "X-Forwarded-Uri": {"/"}})
+	}
+
+	verify("new.example.com")
+	verify("new.example.com:8443")
+	verify("example.net")
+	verify("example.com.evil.net")
+
+	tests := []struct {
+		host    string
+		pending bool
+	}{
+		{"new.example.com", true},
+		{"new.example.com:8443", true},
+		{"example.net", false},
+		{"example.com.evil.net", false},
+	}
+	for _, tt := range tests {
+		h, err := app.db.GetHost(tt.host)
+		if tt.pending && (err != nil || !h.Pending) {
+			t.Errorf("host %s: got %v %v, want pending", tt.host, h, err)
+		}
+		if !tt.pending && err != tobab.ErrNotFound {
+			t.Errorf("host %s outside the cookie scope was discovered", tt.host)
+		}
+	}
+
+	for i := app.pendingHosts(); i < MAX_PENDING_HOSTS; i++ {
+		err := app.db.SetHost(tobab.Host{Name: fmt.Sprintf("h%d.example.com", i), Pending: true, LastSeen: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	verify("one-too-many.example.com")
+	if _, err := app.db.GetHost("one-too-many.example.com"); err != tobab.ErrNotFound {
+		t.Errorf("host was discovered with %d pending hosts", MAX_PENDING_HOSTS)
+	}
+
+	stale := tobab.Host{Name: "stale.example.com", Pending: true, LastSeen: time.Now().Add(-PENDING_HOST_MAX_AGE - time.Hour)}
+	accepted := tobab.Host{Name: "old.example.com", LastSeen: stale.LastSeen}
+	for _, h := range []tobab.Host{stale, accepted} {
+		if err := app.db.SetHost(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n, err := app.cleanPendingHosts()
+	if err != nil || n != 1 {
+		t.Errorf("cleanPendingHosts() = %d, %v, want 1 stale host", n, err)
+	}
+	if _, err := app.db.GetHost(stale.Name); err != tobab.ErrNotFound {
+		t.Errorf("stale pending host was not deleted")
+	}
+	if app.getHost(accepted.Name) == nil {
+		t.Errorf("accepted host that was not seen for a while was deleted")
+	}
+}
+
+func TestDeleteHostRevokesAccess(t *testing.T) {
+	app, srv := newTestServer(t)
+
+	const host = "secure.example.com"
+	if err := app.db.SetHost(tobab.Host{Name: host, Policy: tobab.HOST_POLICY_PRIVATE}); err != nil {
+		t.Fatal(err)
+	}
+	users := []tobab.User{
+		{ID: []byte("admin"), Name: "admin", Admin: true, AccessibleHosts: []string{host}},
+		{ID: []byte("alice"), Name: "alice", AccessibleHosts: []string{host, "other.example.com"}},
+		{ID: []byte("bob"), Name: "bob", Grants: []tobab.Grant{{Host: host, NotAfter: time.Now().Add(time.Hour)}}},
+		{ID: []byte("carol"), Name: "carol", Grants: []tobab.Grant{{Host: host, NotBefore: time.Now().Add(time.Hour)}}},
+	}
+	for _, u := range users {
+		if err := app.db.SetUser(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := app.db.SetGroup(tobab.Group{ID: "ops", Name: "ops", AccessibleHosts: []string{host}}); err != nil {
+		t.Fatal(err)
+	}
+
+	b := newBrowser(t, srv.URL)
+	sess := b.login(app, users[0])
+	res, _ := b.do("POST", "/admin/hosts/delete?host="+host, nil, http.Header{CSRF_HEADER: {sess.Vals["csrf"]}})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("delete host: got %d, want 200", res.StatusCode)
+	}
+
+	for _, u := range users {
+		got, err := app.db.GetUserByName(u.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tobab.Contains(got.AccessibleHosts, host) || got.Grant(host) != nil {
+			t.Errorf("%s kept access to the deleted host: %v %+v", u.Name, got.AccessibleHosts, got.Grants)
+		}
+	}
+	if alice, _ := app.db.GetUserByName("alice"); !tobab.Contains(alice.AccessibleHosts, "other.example.com") {
+		t.Errorf("alice lost access to another host")
+	}
+	if g, _ := app.db.GetGroup("ops"); tobab.Contains(g.AccessibleHosts, host) {
+		t.Errorf("group kept access to the deleted host")
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gnur/tobab"
+	"github.com/lithammer/shortuuid"
+)
+
+const INVITE_AGE = 7 * 24 * time.Hour
+
+type inviteVars struct {
+	State string
+	User  tobab.User
+	CSRF  string
+
+	InviteOnly bool
+	Invites    []tobab.Invite
+	Hosts      []string
+	Groups     []tobab.Group
+	NewLink    string
+}
+
+func (app *Tobab) setInviteRoutes(admin *gin.RouterGroup) {
+
+	admin.GET("/invites.html", func(c *gin.Context) {
+		app.renderInvites(c, "")
+	})
+
+	admin.POST("/invites/create", func(c *gin.Context) {
+		sess := app.getSession(c.GetString("SESSION_ID"))
+		user, err := app.db.GetUser(sess.UserID)
+		if err != nil {
+			app.logger.Error("failed to retrieve user from session", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		d, err := time.ParseDuration(c.DefaultPostForm("expires", INVITE_AGE.String()))
+		if err != nil || d <= 0 {
+			app.logger.Warn("invalid expiry provided", "expires", c.PostForm("expires"))
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		hosts := c.PostFormArray("hosts")
+		for _, h := range hosts {
+			if !tobab.Contains(app.getHosts(), h) {
+				app.logger.Warn("invalid hostname provided", "host", h)
+				c.AbortWithStatus(http.StatusBadRequest)
+				return
+			}
+		}
+
+		groups := c.PostFormArray("groups")
+		for _, g := range groups {
+			if _, err := app.db.GetGroup(g); err != nil {
+				app.logger.Warn("invalid group provided", "error", err)
+				c.AbortWithStatus(http.StatusBadRequest)
+				return
+			}
+		}
+
+		link, err := app.createInvite(c, tobab.Invite{
+			Note:      strings.TrimSpace(c.PostForm("note")),
+			CreatedBy: user.Name,
+			Expires:   time.Now().Add(d),
+			Hosts:     hosts,
+			Groups:    groups,
+		})
+		if err != nil {
+			app.logger.Error("failed to create invite", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		app.renderInvites(c, link)
+	})
+
+	admin.POST("/invites/revoke", func(c *gin.Context) {
+		err := app.db.DeleteInvite(c.Query("id"))
+		if err == tobab.ErrNotFound {
+			app.logger.Warn("invalid invite provided", "id", c.Query("id"))
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			app.logger.Error("failed to delete invite", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		app.logger.Info("revoked invite", "id", c.Query("id"))
+		c.Header("HX-Refresh", "true")
+		c.JSON(200, gin.H{})
+	})
+}
+
+func (app *Tobab) renderInvites(c *gin.Context, newLink string) {
+	invites, err := app.db.GetInvites()
+	if err != nil {
+		app.logger.Error("failed to retrieve invites from database", "error", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	sess := app.getSession(c.GetString("SESSION_ID"))
+	user, err := app.db.GetUser(sess.UserID)
+	if err != nil {
+		app.logger.Error("failed to retrieve user from session", "error", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.HTML(200, "invites.html", inviteVars{
+		CSRF:       c.GetString("CSRF_TOKEN"),
+		State:      sess.State,
+		User:       *user,
+		InviteOnly: app.config.InviteOnly,
+		Invites:    invites,
+		Hosts:      app.getHosts(),
+		Groups:     app.getGroups(),
+		NewLink:    newLink,
+	})
+}
+
+// createInvite stores inv with a new token and returns the registration link that contains the token, c is nil when called from the cli
+func (app *Tobab) createInvite(c *gin.Context, inv tobab.Invite) (string, error) {
+	token, err := randomString(32)
+	if err != nil {
+		return "", err
+	}
+
+	inv.ID = shortuuid.New()
+	inv.Hash = tobab.HashSecret(token)
+	inv.Created = time.Now()
+
+	err = app.db.SetInvite(inv)
+	if err != nil {
+		return "", err
+	}
+
+	app.audit(c, tobab.AuditEvent{
+		Type:   tobab.AUDIT_INVITE_CREATED,
+		Actor:  inv.CreatedBy,
+		Detail: "invite " + inv.ID + " expires " + inv.Expires.Format(time.RFC3339),
+	})
+	return app.fqdn + "/register.html?invite=" + token, nil
+}
+
+// validInvite returns the invite that belongs to token as long as it has not expired
+func (app *Tobab) validInvite(token string) (*tobab.Invite, error) {
+	if token == "" {
+		return nil, tobab.ErrNotFound
+	}
+	inv, err := app.db.GetInviteByHash(tobab.HashSecret(token))
+	if err != nil {
+		return nil, err
+	}
+	if inv.Expired() {
+		return nil, fmt.Errorf("invite %s expired at %s", inv.ID, inv.Expires)
+	}
+	return inv, nil
+}
+
+// inviteRequired reports whether registering needs an invite, the first user can always register so an admin exists
+func (app *Tobab) inviteRequired() bool {
+	if !app.config.InviteOnly {
+		return false
+	}
+	hasAdmin, err := app.db.KVGetBool(ADMIN_REGISTERED_KEY)
+	return err != nil || hasAdmin
+}
+
+// inviteCommand creates an invite from the command line and prints its registration link
+func (app *Tobab) inviteCommand(args []string) error {
+	fs := flag.NewFlagSet("invite", flag.ContinueOnError)
+	note := fs.String("note", "", "note to recognize the invite by")
+	expires := fs.Duration("expires", INVITE_AGE, "how long the invite can be used")
+	hosts := fs.String("hosts", "", "comma separated hosts the new user gets access to")
+	groups := fs.String("groups", "", "comma separated names of the groups the new user joins")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	inv := tobab.Invite{
+		Note:      *note,
+		CreatedBy: "cli",
+		Expires:   time.Now().Add(*expires),
+	}
+
+	for _, h := range strings.Split(*hosts, ",") {
+		if h = strings.TrimSpace(h); h == "" {
+			continue
+		}
+		if !tobab.Contains(app.getHosts(), h) {
+			return fmt.Errorf("unknown host %q", h)
+		}
+		inv.Hosts = append(inv.Hosts, h)
+	}
+
+	for _, name := range strings.Split(*groups, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		found := false
+		for _, g := range app.getGroups() {
+			if g.Name == name {
+				inv.Groups = append(inv.Groups, g.ID)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown group %q", name)
+		}
+	}
+
+	link, err := app.createInvite(nil, inv)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(link)
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gnur/tobab"
+)
+
+var inviteLink = regexp.MustCompile(`register\.html\?invite=([A-Za-z0-9_-]+)`)
+
+// register runs a passkey registration for name with invite in a new browser, finish is only called when start succeeded
+func register(t *testing.T, app *Tobab, base, name, invite string) (start, finish int) {
+	t.Helper()
+	b := newBrowser(t, base)
+	token := b.csrfToken("/register.html?invite=" + invite)
+	header := http.Header{"Content-Type": {"application/json"}, CSRF_HEADER: {token}}
+
+	res, options := b.do("POST", "/passkey/register/start", strings.NewReader(`{"Name": "`+name+`", "Invite": "`+invite+`"}`), header)
+	if res.StatusCode != http.StatusOK {
+		return res.StatusCode, 0
+	}
+	body := softAuthenticator{t: t, origin: app.fqdn}.create(options)
+	res, _ = b.do("POST", "/passkey/register/finish", strings.NewReader(body), header)
+	return http.StatusOK, res.StatusCode
+}
+
+func TestInvites(t *testing.T) {
+	app, srv := newTestServer(t)
+	app.config.InviteOnly = true
+	if err := app.db.KVSet(ADMIN_REGISTERED_KEY, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.db.SetHost(tobab.Host{Name: "secure.example.com", Policy: tobab.HOST_POLICY_PRIVATE}); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.db.SetGroup(tobab.Group{ID: "ops", Name: "ops"}); err != nil {
+		t.Fatal(err)
+	}
+	admin := tobab.User{ID: []byte("admin"), Name: "admin", Admin: true}
+	if err := app.db.SetUser(admin); err != nil {
+		t.Fatal(err)
+	}
+	a := newBrowser(t, srv.URL)
+	adminSess := a.login(app, admin)
+
+	createInvite := func() string {
+		t.Helper()
+		form := url.Values{"note": {"test"}, "expires": {"1h"}, "hosts": {"secure.example.com"}, "groups": {"ops"}}
+		res, body := a.do("POST", "/admin/invites/create", strings.NewReader(form.Encode()), http.Header{
+			"Content-Type": {"application/x-www-form-urlencoded"},
+			CSRF_HEADER:    {adminSess.Vals["csrf"]},
+		})
+		m := inviteLink.FindStringSubmatch(body)
+		if res.StatusCode != http.StatusOK || m == nil {
+			t.Fatalf("create invite: got %d without a link", res.StatusCode)
+		}
+		return m[1]
+	}
+
+	if start, _ := register(t, app, srv.URL, "nobody", ""); start != http.StatusForbidden {
+		t.Errorf("registration without invite: got %d, want 403", start)
+	}
+	if start, _ := register(t, app, srv.URL, "nobody", "not-an-invite"); start != http.StatusForbidden {
+		t.Errorf("registration with unknown invite: got %d, want 403", start)
+	}
+
+	invite := createInvite()
+	start, finish := register(t, app, srv.URL, "alice", invite)
+	if start != http.StatusOK || finish != http.StatusOK {
+		t.Fatalf("registration with invite: got %d and %d, want 200", start, finish)
+	}
+	alice, err := app.db.GetUserByName("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tobab.Contains(alice.AccessibleHosts, "secure.example.com") || !tobab.Contains(alice.Groups, "ops") || len(alice.Creds) != 1 || alice.Admin {
+		t.Errorf("alice after registration: hosts %v, groups %v, %d passkeys, admin %v", alice.AccessibleHosts, alice.Groups, len(alice.Creds), alice.Admin)
+	}
+
+	if start, _ := register(t, app, srv.URL, "bob", invite); start != http.StatusForbidden {
+		t.Errorf("second registration with the same invite: got %d, want 403", start)
+	}
+
+	//two registrations started with the same invite, only the first to finish gets it
+	invite = createInvite()
+	carol := newBrowser(t, srv.URL)
+	dave := newBrowser(t, srv.URL)
+	options := map[*browser]string{}
+	headers := map[*browser]http.Header{}
+	for name, br := range map[string]*browser{"carol": carol, "dave": dave} {
+		token := br.csrfToken("/register.html?invite=" + invite)
+		headers[br] = http.Header{"Content-Type": {"application/json"}, CSRF_HEADER: {token}}
+		res, body := br.do("POST", "/passkey/register/start", strings.NewReader(`{"Name": "`+name+`", "Invite": "`+invite+`"}`), headers[br])
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("register start for %s: got %d", name, res.StatusCode)
+		}
+		options[br] = body
+	}
+	res, _ := carol.do("POST", "/passkey/register/finish", strings.NewReader(softAuthenticator{t: t, origin: app.fqdn}.create(options[carol])), headers[carol])
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("first finish with the invite: got %d, want 200", res.StatusCode)
+	}
+	res, _ = dave.do("POST", "/passkey/register/finish", strings.NewReader(softAuthenticator{t: t, origin: app.fqdn}.create(options[dave])), headers[dave])
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("second finish with the same invite: got %d, want 403", res.StatusCode)
+	}
+
+	invite = createInvite()
+	inv, err := app.db.GetInviteByHash(tobab.HashSecret(invite))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, _ = a.do("POST", "/admin/invites/revoke?id="+inv.ID, nil, http.Header{CSRF_HEADER: {adminSess.Vals["csrf"]}})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("revoke invite: got %d", res.StatusCode)
+	}
+	if start, _ := register(t, app, srv.URL, "erin", invite); start != http.StatusForbidden {
+		t.Errorf("registration with revoked invite: got %d, want 403", start)
+	}
+
+	err = app.db.SetInvite(tobab.Invite{ID: "expired", Hash: tobab.HashSecret("expired-invite"), Created: time.Now(), Expires: time.Now().Add(-time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if start, _ := register(t, app, srv.URL, "frank", "expired-invite"); start != http.StatusForbidden {
+		t.Errorf("registration with expired invite: got %d, want 403", start)
+	}
+}
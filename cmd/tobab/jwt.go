@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gnur/tobab"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/lithammer/shortuuid"
+)
+
+const SIGNING_KEYS_KEY = "signing_keys"
+
+type identityClaims struct {
+	Name   string   `json:"name"`
+	Groups []string `json:"groups"`
+	Host   string   `json:"host"`
+	jwt.RegisteredClaims
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+}
+
+func (app *Tobab) setJWKSRoutes(r *gin.Engine) {
+	r.GET("/.well-known/jwks.json", func(c *gin.Context) {
+		keys := []jwk{}
+		for _, k := range app.getSigningKeys() {
+			priv, err := parseSigningKey(k)
+			if err != nil {
+				app.logger.Error("failed to parse signing key", "error", err, "kid", k.ID)
+				continue
+			}
+			keys = append(keys, jwk{
+				Kty: "EC",
+				Crv: "P-256",
+				X:   base64.RawURLEncoding.EncodeToString(priv.X.FillBytes(make([]byte, 32))),
+				Y:   base64.RawURLEncoding.EncodeToString(priv.Y.FillBytes(make([]byte, 32))),
+				Kid: k.ID,
+				Use: "sig",
+				Alg: "ES256",
+			})
+		}
+
+		c.Header("Cache-Control", "public, max-age=300")
+		c.JSON(200, gin.H{
+			"keys": keys,
+		})
+	})
+}
+
+// getSigningKeys returns all keys that can still be used to verify tokens, newest first
+func (app *Tobab) getSigningKeys() []tobab.SigningKey {
+	var keys []tobab.SigningKey
+	err := app.db.KVGet(SIGNING_KEYS_KEY, &keys)
+	if err != nil && err != tobab.ErrNotFound {
+		app.logger.Error("Failed to get signing keys", "error", err)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Created.After(keys[j].Created)
+	})
+	return keys
+}
+
+// rotateSigningKeys creates a new signing key once the newest key is older than the rotation interval,
+// keys are kept around for another interval so tokens signed just before a rotation can still be verified
+func (app *Tobab) rotateSigningKeys() error {
+	keys := app.getSigningKeys()
+	if len(keys) > 0 && time.Since(keys[0].Created) < app.keyRotation {
+		return nil
+	}
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return err
+	}
+
+	newKeys := []tobab.SigningKey{{
+		ID:      shortuuid.New(),
+		Created: time.Now(),
+		Key:     der,
+	}}
+	for _, k := range keys {
+		if time.Since(k.Created) < 2*app.keyRotation {
+			newKeys = append(newKeys, k)
+		}
+	}
+
+	app.logger.Info("rotated signing keys", "kid", newKeys[0].ID, "keys", len(newKeys))
+	return app.db.KVSet(SIGNING_KEYS_KEY, newKeys)
+}
+
+func (app *Tobab) rotateSigningKeysLoop() {
+	for {
+		err := app.rotateSigningKeys()
+		if err != nil {
+			app.logger.Error("failed to rotate signing keys", "error", err)
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+func parseSigningKey(k tobab.SigningKey) (*ecdsa.PrivateKey, error) {
+	key, err := x509.ParsePKCS8PrivateKey(k.Key)
+	if err != nil {
+		return nil, err
+	}
+	priv, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("signing key %s is not an ecdsa key", k.ID)
+	}
+	return priv, nil
+}
+
+// signToken signs claims with the newest signing key
+func (app *Tobab) signToken(claims jwt.Claims) (string, error) {
+	keys := app.getSigningKeys()
+	if len(keys) == 0 {
+		return "", errors.New("no signing keys available")
+	}
+
+	priv, err := parseSigningKey(keys[0])
+	if err != nil {
+		return "", err
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["kid"] = keys[0].ID
+	return token.SignedString(priv)
+}
+
+// signIdentityToken returns a short lived token that proves to the upstream for host who the user is
+func (app *Tobab) signIdentityToken(user *tobab.User, groups []string, host string) (string, error) {
+	now := time.Now()
+	return app.signToken(identityClaims{
+		Name:   user.Name,
+		Groups: groups,
+		Host:   host,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    app.fqdn,
+			Subject:   string(user.ID),
+			Audience:  jwt.ClaimStrings{host},
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(app.jwtAge)),
+		},
+	})
+}
+
+// parseToken validates a token signed by one of the current signing keys and decodes it into claims
+func (app *Tobab) parseToken(token string, claims jwt.Claims, opts ...jwt.ParserOption) error {
+	opts = append(opts, jwt.WithValidMethods([]string{"ES256"}), jwt.WithIssuer(app.fqdn))
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (any, error) {
+		for _, k := range app.getSigningKeys() {
+			if k.ID != t.Header["kid"] {
+				continue
+			}
+			priv, err := parseSigningKey(k)
+			if err != nil {
+				return nil, err
+			}
+			return &priv.PublicKey, nil
+		}
+		return nil, errors.New("unknown signing key")
+	}, opts...)
+	return err
+}
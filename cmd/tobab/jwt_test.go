@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gnur/tobab"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// fetchJWKS returns the public keys tobab publishes, by kid
+func fetchJWKS(t *testing.T, b *browser) map[string]*ecdsa.PublicKey {
+	t.Helper()
+	res, body := b.do("GET", "/.well-known/jwks.json", nil, nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("jwks: got %d", res.StatusCode)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal([]byte(body), &set); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := map[string]*ecdsa.PublicKey{}
+	for _, k := range set.Keys {
+		x, errX := base64.RawURLEncoding.DecodeString(k.X)
+		y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+		if errX != nil || errY != nil || k.Kty != "EC" || k.Crv != "P-256" || k.Alg != "ES256" {
+			t.Fatalf("invalid jwk %+v", k)
+		}
+		keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	}
+	return keys
+}
+
+// parseWithJWKS validates token like an upstream would, with only the published keys
+func parseWithJWKS(token string, keys map[string]*ecdsa.PublicKey, claims jwt.Claims, opts ...jwt.ParserOption) error {
+	opts = append(opts, jwt.WithValidMethods([]string{"ES256"}))
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		if k, ok := keys[kid]; ok {
+			return k, nil
+		}
+		return nil, errors.New("unknown kid")
+	}, opts...)
+	return err
+}
+
+// ageSigningKeys moves the creation time of every stored signing key d into the past
+func ageSigningKeys(t *testing.T, app *Tobab, d time.Duration) {
+	t.Helper()
+	keys := app.getSigningKeys()
+	for i := range keys {
+		keys[i].Created = keys[i].Created.Add(-d)
+	}
+	if err := app.db.KVSet(SIGNING_KEYS_KEY, keys); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIdentityTokenJWKS(t *testing.T) {
+	app, srv := newTestServer(t)
+	b := newBrowser(t, srv.URL)
+
+	if err := app.db.SetHost(tobab.Host{Name: "secure.example.com", Policy: tobab.HOST_POLICY_PRIVATE}); err != nil {
+		t.Fatal(err)
+	}
+	alice := tobab.User{ID: []byte("alice"), Name: "alice", AccessibleHosts: []string{"secure.example.com"}}
+	if err := app.db.SetUser(alice); err != nil {
+		t.Fatal(err)
+	}
+	b.login(app, alice)
+
+	res, _ := b.do("GET", "/verify", nil, http.Header{"X-Forwarded-Host": {"secure.example.com"}, "X-Forwarded-Uri": {"/"}})
+	token := res.Header.Get(app.jwtHeader)
+	if res.StatusCode != http.StatusOK || token == "" {
+		t.Fatalf("verify: got %d without an identity token", res.StatusCode)
+	}
+
+	keys := fetchJWKS(t, b)
+	var claims identityClaims
+	err := parseWithJWKS(token, keys, &claims, jwt.WithAudience("secure.example.com"), jwt.WithIssuer(app.fqdn))
+	if err != nil {
+		t.Fatalf("identity token doesn't validate against the jwks: %v", err)
+	}
+	if claims.Subject != "alice" || claims.Name != "alice" || claims.Host != "secure.example.com" {
+		t.Errorf("identity token claims %+v, want alice for secure.example.com", claims)
+	}
+	if err := parseWithJWKS(token, keys, &identityClaims{}, jwt.WithAudience("other.example.com")); err == nil {
+		t.Errorf("identity token for secure.example.com was accepted for other.example.com")
+	}
+}
+
+func TestSigningKeyRotation(t *testing.T) {
+	app, srv := newTestServer(t)
+	b := newBrowser(t, srv.URL)
+	alice := &tobab.User{ID: []byte("alice"), Name: "alice"}
+
+	oldToken, err := app.signIdentityToken(alice, nil, "secure.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldKid := app.getSigningKeys()[0].ID
+
+	//no new key within the rotation interval
+	if err := app.rotateSigningKeys(); err != nil || len(app.getSigningKeys()) != 1 {
+		t.Fatalf("rotation within the interval: %d keys, %v", len(app.getSigningKeys()), err)
+	}
+
+	ageSigningKeys(t, app, app.keyRotation)
+	if err := app.rotateSigningKeys(); err != nil {
+		t.Fatal(err)
+	}
+	keys := app.getSigningKeys()
+	if len(keys) != 2 || keys[0].ID == oldKid || keys[1].ID != oldKid {
+		t.Fatalf("after rotation: keys %v, want a new key and the previous one", keys)
+	}
+
+	//tokens of the previous key validate for another interval, new tokens use the new key
+	if err := app.parseToken(oldToken, &identityClaims{}); err != nil {
+		t.Errorf("token of the previous key after rotation: %v", err)
+	}
+	jwks := fetchJWKS(t, b)
+	if _, ok := jwks[oldKid]; !ok || len(jwks) != 2 {
+		t.Errorf("jwks after rotation has %d keys, want the new and the previous key", len(jwks))
+	}
+	newToken, err := app.signIdentityToken(alice, nil, "secure.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok, _, _ := jwt.NewParser().ParseUnverified(newToken, &identityClaims{}); tok.Header["kid"] != keys[0].ID {
+		t.Errorf("new token signed with %v, want the new key %s", tok.Header["kid"], keys[0].ID)
+	}
+
+	//one more interval later the previous key is dropped
+	ageSigningKeys(t, app, app.keyRotation)
+	if err := app.rotateSigningKeys(); err != nil {
+		t.Fatal(err)
+	}
+	jwks = fetchJWKS(t, b)
+	if _, ok := jwks[oldKid]; ok {
+		t.Errorf("expired key is still published")
+	}
+	if len(jwks) != 2 {
+		t.Errorf("jwks has %d keys, want the two newest", len(jwks))
+	}
+	if err := app.parseToken(oldToken, &identityClaims{}); err == nil {
+		t.Errorf("token of an expired key still validates")
+	}
+	if err := parseWithJWKS(newToken, jwks, &identityClaims{}); err != nil {
+		t.Errorf("token of the previous key one interval later: %v", err)
+	}
+}
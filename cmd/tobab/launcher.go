@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gnur/tobab"
+)
+
+// launcherApp is a tile on the launcher of the index page
+type launcherApp struct {
+	Host        tobab.Host
+	URL         string
+	LastVisited time.Time
+	Favorite    bool
+}
+
+func (app *Tobab) setLauncherRoutes(r *gin.Engine) {
+
+	r.POST("/launcher/favorite", func(c *gin.Context) {
+		sess := app.getSession(c.GetString("SESSION_ID"))
+		if sess.State != "authenticated" {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+
+		user, err := app.db.GetUser(sess.UserID)
+		if err != nil {
+			app.logger.Error("failed to retrieve user from session", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		host := c.Query("host")
+		if !tobab.Contains(app.getHosts(), host) {
+			app.logger.Warn("invalid hostname provided", "host", host)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		if tobab.Contains(user.Favorites, host) {
+			user.Favorites = remove(user.Favorites, host)
+		} else {
+			user.Favorites = append(user.Favorites, host)
+		}
+
+		err = app.db.SetUser(*user)
+		if err != nil {
+			app.logger.Warn("Failed to update user", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		c.Header("HX-Refresh", "true")
+		c.JSON(200, gin.H{})
+	})
+}
+
+// launcherApps returns the hosts user can access, favorites first and then by title
+func (app *Tobab) launcherApps(user *tobab.User) []launcherApp {
+	hosts, err := app.db.GetHosts()
+	if err != nil {
+		app.logger.Error("failed to retrieve hosts from database", "error", err)
+		return nil
+	}
+
+	//apps are served with the scheme of tobab itself, http in dev mode
+	scheme := "https"
+	if u, err := url.Parse(app.fqdn); err == nil && u.Scheme != "" {
+		scheme = u.Scheme
+	}
+
+	apps := []launcherApp{}
+	for _, h := range hosts {
+		if h.Pending || !app.canAccess(user, h.Name) {
+			continue
+		}
+		apps = append(apps, launcherApp{
+			Host:        h,
+			URL:         scheme + "://" + h.Name,
+			LastVisited: user.Visits[h.Name],
+			Favorite:    tobab.Contains(user.Favorites, h.Name),
+		})
+	}
+
+	sort.Slice(apps, func(i, j int) bool {
+		if apps[i].Favorite != apps[j].Favorite {
+			return apps[i].Favorite
+		}
+		return apps[i].Host.Title() < apps[j].Host.Title()
+	})
+	return apps
+}
+
+// recordVisit remembers when user last visited host for the launcher, at most once a minute
+func (app *Tobab) recordVisit(user *tobab.User, host string) {
+	if time.Since(user.Visits[host]) < time.Minute {
+		return
+	}
+	if user.Visits == nil {
+		user.Visits = make(map[string]time.Time)
+	}
+	user.Visits[host] = time.Now()
+
+	err := app.db.SetUser(*user)
+	if err != nil {
+		app.logger.Error("failed to record visit", "error", err, "host", host)
+	}
+}
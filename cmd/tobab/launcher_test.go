@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gnur/tobab"
+)
+
+func TestLauncherApps(t *testing.T) {
+	app, _ := newTestServer(t)
+
+	hosts := []tobab.Host{
+		{Name: "direct.example.com", Policy: tobab.HOST_POLICY_PRIVATE},
+		{Name: "group.example.com", Policy: tobab.HOST_POLICY_PRIVATE},
+		{Name: "everyone.example.com", Policy: tobab.HOST_POLICY_AUTHENTICATED},
+		{Name: "public.example.com", Policy: tobab.HOST_POLICY_PUBLIC},
+		{Name: "private.example.com", Policy: tobab.HOST_POLICY_PRIVATE},
+		{Name: "pending.example.com", Policy: tobab.HOST_POLICY_PUBLIC, Pending: true},
+	}
+	for _, h := range hosts {
+		if err := app.db.SetHost(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := app.db.SetGroup(tobab.Group{ID: "ops", Name: "ops", AccessibleHosts: []string{"group.example.com"}}); err != nil {
+		t.Fatal(err)
+	}
+	alice := &tobab.User{ID: []byte("alice"), Name: "alice", AccessibleHosts: []string{"direct.example.com"}, Groups: []string{"ops"}}
+
+	got := map[string]string{}
+	for _, a := range app.launcherApps(alice) {
+		got[a.Host.Name] = a.URL
+		if !app.canAccess(alice, a.Host.Name) {
+			t.Errorf("launcher shows %s, which verify denies", a.Host.Name)
+		}
+	}
+	for _, h := range []string{"direct.example.com", "group.example.com", "everyone.example.com", "public.example.com"} {
+		if got[h] != "https://"+h {
+			t.Errorf("launcher url for %s = %q, want https://%s", h, got[h], h)
+		}
+	}
+	for _, h := range []string{"private.example.com", "pending.example.com"} {
+		if _, ok := got[h]; ok {
+			t.Errorf("launcher shows %s", h)
+		}
+	}
+
+	app.fqdn = "http://localhost:8080"
+	for _, a := range app.launcherApps(alice) {
+		if a.URL != "http://"+a.Host.Name {
+			t.Errorf("launcher url in dev mode = %q, want http://%s", a.URL, a.Host.Name)
+		}
+	}
+}
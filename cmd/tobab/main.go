@@ -2,13 +2,18 @@ package main
 
 import (
 	"html/template"
+	"io"
 	"log/slog"
+	"net"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-contrib/gzip"
 	"github.com/gin-gonic/gin"
 	"github.com/gnur/tobab"
+	"github.com/gnur/tobab/sqlite"
 	"github.com/gnur/tobab/storm"
 	"github.com/go-webauthn/webauthn/protocol"
 	"github.com/go-webauthn/webauthn/webauthn"
@@ -17,15 +22,23 @@ import (
 var version = "manual build"
 
 type Tobab struct {
-	fqdn       string
-	config     tobab.Config
-	logger     *slog.Logger
-	maxAge     time.Duration
-	defaultAge time.Duration
-	templates  *template.Template
-	confLoc    string
-	db         tobab.Database
-	webauthn   *webauthn.WebAuthn
+	fqdn        string
+	config      tobab.Config
+	logger      *slog.Logger
+	maxAge      time.Duration
+	defaultAge  time.Duration
+	jwtAge      time.Duration
+	keyRotation time.Duration
+	jwtHeader   string
+	templates   *template.Template
+	confLoc     string
+	db          tobab.Database
+	webauthn    *webauthn.WebAuthn
+	codesMu     sync.Mutex
+	recoveryMu  sync.Mutex
+	auditLog    io.Writer
+	auditMu     sync.Mutex
+	proxies     []*net.IPNet
 }
 
 func main() {
@@ -47,12 +60,36 @@ func main() {
 		version = "unknown"
 	}
 
-	db, err := storm.New(cfg.DatabasePath)
+	db, err := openDatabase(cfg)
 	if err != nil {
-		logger.Error("unable to init database", "error", err, "location", cfg.DatabasePath)
+		logger.Error("unable to init database", "error", err, "location", cfg.DatabasePath, "type", cfg.DatabaseType)
+		if len(os.Args) > 1 && cfg.DatabaseType != "sqlite" {
+			logger.Error("storm allows one process at a time, stop the server first or create the invite at /admin/invites.html")
+			os.Exit(1)
+		}
+		return
 	}
 	defer db.Close()
 
+	if cfg.MetricsAddress != "" {
+		db = instrumentedDB{db: db}
+	}
+
+	proxies, err := parseTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		logger.Error("invalid trusted proxies", "error", err)
+		return
+	}
+	if len(proxies) == 0 {
+		logger.Warn("no trustedproxies configured, forwarded headers are trusted from every source, this is insecure when tobab can be reached without going through a proxy")
+	}
+
+	auditLog, err := openAuditLog(cfg.AuditLog)
+	if err != nil {
+		logger.Error("unable to open audit log", "error", err, "location", cfg.AuditLog)
+		return
+	}
+
 	fqdn := "https://" + cfg.Hostname
 	if cfg.Dev {
 		fqdn = "http://localhost:8080"
@@ -78,8 +115,27 @@ func main() {
 		confLoc:  confLoc,
 		db:       db,
 		webauthn: w,
+		auditLog: auditLog,
+		proxies:  proxies,
+	}
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "invite":
+			err = app.inviteCommand(os.Args[2:])
+			if err != nil {
+				logger.Error("failed to create invite", "error", err)
+				os.Exit(1)
+			}
+		default:
+			logger.Error("unknown command", "command", os.Args[1])
+			os.Exit(2)
+		}
+		return
 	}
 
+	app.migrateHosts()
+
 	//check if admin is created already, otherwise set it to false
 	hasAdmin, err := app.db.KVGetBool(ADMIN_REGISTERED_KEY)
 	if err != nil || !hasAdmin {
@@ -99,6 +155,29 @@ func main() {
 		app.maxAge = age
 	}
 
+	if age, err := time.ParseDuration(cfg.JWTAge); err != nil {
+		app.jwtAge = 5 * time.Minute
+	} else {
+		app.jwtAge = age
+	}
+
+	if age, err := time.ParseDuration(cfg.JWTKeyRotation); err != nil {
+		app.keyRotation = 7 * 24 * time.Hour
+	} else {
+		app.keyRotation = age
+	}
+
+	app.jwtHeader = cfg.JWTHeader
+	if app.jwtHeader == "" {
+		app.jwtHeader = "X-Tobab-Token"
+	}
+
+	err = app.rotateSigningKeys()
+	if err != nil {
+		logger.Error("unable to create signing keys", "error", err)
+		return
+	}
+
 	app.templates, err = loadTemplates()
 	if err != nil {
 		logger.Error("unable to load templates", "error", err)
@@ -106,11 +185,28 @@ func main() {
 	}
 
 	go app.cleanSessionsLoop()
+	go app.pruneGrantsLoop()
+	go app.rotateSigningKeysLoop()
+	if cfg.MetricsAddress != "" {
+		go app.startMetricsServer(cfg.MetricsAddress)
+	}
+	if cfg.ExtAuthzAddress != "" {
+		go app.startExtAuthzServer(cfg.ExtAuthzAddress)
+	}
 
 	app.startServer()
 
 }
 
+func openDatabase(cfg tobab.Config) (tobab.Database, error) {
+	switch cfg.DatabaseType {
+	case "sqlite":
+		return sqlite.New(cfg.DatabasePath)
+	default:
+		return storm.New(cfg.DatabasePath)
+	}
+}
+
 func (app *Tobab) startServer() {
 	app.logger.Info("starting server")
 
@@ -131,49 +227,102 @@ func (app *Tobab) startServer() {
 		r.SetHTMLTemplate(app.templates)
 	}
 
+	err := app.setTrustedProxies(r)
+	if err != nil {
+		app.logger.Error("Failed to set trusted proxies", "error", err)
+		return
+	}
+
+	r.Use(app.metricsMiddleware())
 	r.Use(gzip.Gzip(gzip.DefaultCompression))
 	r.Use(app.getSessionMiddleware())
+	r.Use(app.csrfMiddleware())
 	app.setTobabRoutes(r)
 
-	err := r.Run()
+	err = r.Run()
 	if err != nil {
 		app.logger.Error("Failed to start web server")
 	}
 }
 
-func (app *Tobab) getHosts() []string {
-	var hosts []string
-	err := app.db.KVGet("hosts", &hosts)
-	if err != nil {
-		app.logger.Error("Failed to get hosts", "error", err)
+// setTrustedProxies makes gin take the client IP from forwarded headers only for requests of the trusted proxies,
+// without trusted proxies gin keeps trusting every source
+func (app *Tobab) setTrustedProxies(r *gin.Engine) error {
+	if len(app.proxies) == 0 {
+		return nil
 	}
-	return hosts
+	return r.SetTrustedProxies(app.config.TrustedProxies)
 }
 
-func (app *Tobab) addHost(h string) {
-	var hosts []string
-
-	err := app.db.KVGet("hosts", &hosts)
-	if err != nil {
-		app.logger.Error("Failed to get hosts", "error", err)
+// parseTrustedProxies parses a list of CIDRs or single IP addresses
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, p := range proxies {
+		if !strings.Contains(p, "/") {
+			if ip := net.ParseIP(p); ip != nil && ip.To4() != nil {
+				p += "/32"
+			} else {
+				p += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
 	}
+	return nets, nil
+}
 
-	if tobab.Contains(hosts, h) {
-		return
-	}
+// fromTrustedProxy reports whether the request was sent by one of the trusted proxies, every source is trusted when none are configured
+func (app *Tobab) fromTrustedProxy(c *gin.Context) bool {
+	return app.trustedProxy(c.RemoteIP())
+}
 
-	hosts = append(hosts, h)
-	err = app.db.KVSet("hosts", hosts)
-	if err != nil {
-		app.logger.Error("Failed to set hosts", "error", err)
+// trustedProxy reports whether remote is the address of one of the trusted proxies
+func (app *Tobab) trustedProxy(remote string) bool {
+	if len(app.proxies) == 0 {
+		return true
+	}
+	ip := net.ParseIP(remote)
+	if ip == nil {
+		return false
 	}
+	for _, n := range app.proxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
 }
 
 func (app *Tobab) cleanSessionsLoop() {
 	time.Sleep(2 * time.Second)
 	for {
-		app.logger.Info("cleaning old sessions")
-		app.db.CleanupOldSessions()
+		n, err := app.db.CleanupOldSessions()
+		if err != nil {
+			app.logger.Error("failed to clean old sessions", "error", err)
+		}
+		app.logger.Info("cleaned old sessions", "sessions", n)
+		sessionsCleaned.Add(float64(n))
+
+		n, err = app.cleanPendingHosts()
+		if err != nil {
+			app.logger.Error("failed to clean pending hosts", "error", err)
+		}
+		app.logger.Info("cleaned pending hosts", "hosts", n)
 		time.Sleep(time.Hour)
 	}
 }
+
+func (app *Tobab) pruneGrantsLoop() {
+	time.Sleep(2 * time.Second)
+	for {
+		n, err := app.pruneGrants()
+		if err != nil {
+			app.logger.Error("failed to prune expired grants", "error", err)
+		}
+		app.logger.Info("pruned expired grants", "grants", n)
+		time.Sleep(10 * time.Minute)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "tobab",
+		Name:      "http_request_duration_seconds",
+		Help:      "Duration of http requests by route, method and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "code"})
+
+	verifyDecisions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "tobab",
+		Name:      "verify_decisions_total",
+		Help:      "Forward auth decisions by host and result (allow, redirect, deny or error).",
+	}, []string{"host", "result"})
+
+	verifyDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "tobab",
+		Name:      "verify_duration_seconds",
+		Help:      "Duration of forward auth decisions by result.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"result"})
+
+	passkeyAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "tobab",
+		Name:      "passkey_attempts_total",
+		Help:      "Passkey ceremony requests by flow (register, login, add, recover) and stage (start, finish).",
+	}, []string{"flow", "stage"})
+
+	passkeyFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "tobab",
+		Name:      "passkey_failures_total",
+		Help:      "Failed passkey ceremony requests by flow (register, login, add, recover) and stage (start, finish).",
+	}, []string{"flow", "stage"})
+
+	dbDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "tobab",
+		Name:      "database_operation_duration_seconds",
+		Help:      "Duration of database operations by operation.",
+		Buckets:   []float64{.0001, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, 1},
+	}, []string{"operation"})
+
+	sessionsCleaned = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "tobab",
+		Name:      "sessions_cleaned_total",
+		Help:      "Expired sessions removed by the session cleanup loop.",
+	})
+)
+
+// metricsMiddleware records the duration of every request, and the outcome of forward auth and passkey requests
+func (app *Tobab) metricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		elapsed := time.Since(start).Seconds()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		status := c.Writer.Status()
+		httpDuration.WithLabelValues(route, c.Request.Method, strconv.Itoa(status)).Observe(elapsed)
+
+		if route == "/verify" || route == EXT_AUTHZ_ROUTE {
+			result := c.GetString("VERIFY_RESULT")
+			if result == "" {
+				result = verifyResult(status)
+			}
+			app.observeVerify(c.GetString("VERIFY_HOST"), result, start)
+		}
+
+		//passkey routes are /passkey/<flow>/<stage>
+		if strings.HasPrefix(route, "/passkey/") {
+			parts := strings.Split(strings.TrimPrefix(route, "/passkey/"), "/")
+			if len(parts) == 2 {
+				flow, stage := parts[0], strings.TrimPrefix(parts[1], "any")
+				passkeyAttempts.WithLabelValues(flow, stage).Inc()
+				if status >= 400 {
+					passkeyFailures.WithLabelValues(flow, stage).Inc()
+				}
+			}
+		}
+	}
+}
+
+// METRIC_HOST_OTHER is the host label of decisions for hosts that are not accepted
+const METRIC_HOST_OTHER = "other"
+
+// observeVerify records a forward auth decision that was asked for at start.
+// The host comes from the client, only accepted hosts get their own series so clients can't create new ones.
+func (app *Tobab) observeVerify(host, result string, start time.Time) {
+	if app.getHost(host) == nil {
+		host = METRIC_HOST_OTHER
+	}
+	verifyDecisions.WithLabelValues(host, result).Inc()
+	verifyDuration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+}
+
+func verifyResult(status int) string {
+	switch {
+	case status >= 500:
+		return VERIFY_ERROR
+	case status >= 400:
+		return VERIFY_DENY
+	case status >= 300:
+		return VERIFY_REDIRECT
+	default:
+		return VERIFY_ALLOW
+	}
+}
+
+// startMetricsServer serves the prometheus metrics on their own address so they are not exposed through the proxy
+func (app *Tobab) startMetricsServer(addr string) {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "tobab",
+		Name:      "active_sessions",
+		Help:      "Sessions that are logged in and not expired.",
+	}, func() float64 {
+		n, err := app.db.CountActiveSessions()
+		if err != nil {
+			app.logger.Error("failed to count active sessions", "error", err)
+		}
+		return float64(n)
+	}))
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	app.logger.Info("starting metrics server", "address", addr)
+	err := http.ListenAndServe(addr, mux)
+	if err != nil {
+		app.logger.Error("Failed to start metrics server", "error", err)
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gnur/tobab"
+)
+
+// instrumentedDB records the duration of every call to the wrapped database
+type instrumentedDB struct {
+	db tobab.Database
+}
+
+var _ tobab.Database = instrumentedDB{}
+
+func observeDB(op string, start time.Time) {
+	dbDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+}
+
+func (db instrumentedDB) KVSet(k string, v any) error {
+	defer observeDB("KVSet", time.Now())
+	return db.db.KVSet(k, v)
+}
+
+func (db instrumentedDB) KVGetString(k string) (string, error) {
+	defer observeDB("KVGetString", time.Now())
+	return db.db.KVGetString(k)
+}
+
+func (db instrumentedDB) KVGetBool(k string) (bool, error) {
+	defer observeDB("KVGetBool", time.Now())
+	return db.db.KVGetBool(k)
+}
+
+func (db instrumentedDB) KVGet(k string, v any) error {
+	defer observeDB("KVGet", time.Now())
+	return db.db.KVGet(k, v)
+}
+
+func (db instrumentedDB) GetUsers() ([]tobab.User, error) {
+	defer observeDB("GetUsers", time.Now())
+	return db.db.GetUsers()
+}
+
+func (db instrumentedDB) GetUser(id []byte) (*tobab.User, error) {
+	defer observeDB("GetUser", time.Now())
+	return db.db.GetUser(id)
+}
+
+func (db instrumentedDB) GetUserByName(name string) (*tobab.User, error) {
+	defer observeDB("GetUserByName", time.Now())
+	return db.db.GetUserByName(name)
+}
+
+func (db instrumentedDB) SetUser(u tobab.User) error {
+	defer observeDB("SetUser", time.Now())
+	return db.db.SetUser(u)
+}
+
+func (db instrumentedDB) DeleteUser(id []byte) error {
+	defer observeDB("DeleteUser", time.Now())
+	return db.db.DeleteUser(id)
+}
+
+func (db instrumentedDB) GetSession(id string) (*tobab.Session, error) {
+	defer observeDB("GetSession", time.Now())
+	return db.db.GetSession(id)
+}
+
+func (db instrumentedDB) GetSessionsByUser(userID []byte) ([]tobab.Session, error) {
+	defer observeDB("GetSessionsByUser", time.Now())
+	return db.db.GetSessionsByUser(userID)
+}
+
+func (db instrumentedDB) DeleteSession(id string) error {
+	defer observeDB("DeleteSession", time.Now())
+	return db.db.DeleteSession(id)
+}
+
+func (db instrumentedDB) DeleteSessionsByUser(userID []byte) (int, error) {
+	defer observeDB("DeleteSessionsByUser", time.Now())
+	return db.db.DeleteSessionsByUser(userID)
+}
+
+func (db instrumentedDB) CleanupOldSessions() (int, error) {
+	defer observeDB("CleanupOldSessions", time.Now())
+	return db.db.CleanupOldSessions()
+}
+
+func (db instrumentedDB) CountActiveSessions() (int, error) {
+	defer observeDB("CountActiveSessions", time.Now())
+	return db.db.CountActiveSessions()
+}
+
+func (db instrumentedDB) SetSession(s tobab.Session) error {
+	defer observeDB("SetSession", time.Now())
+	return db.db.SetSession(s)
+}
+
+func (db instrumentedDB) RotateSession(oldID string, s tobab.Session) error {
+	defer observeDB("RotateSession", time.Now())
+	return db.db.RotateSession(oldID, s)
+}
+
+func (db instrumentedDB) GetAPIKeys(userID []byte) ([]tobab.APIKey, error) {
+	defer observeDB("GetAPIKeys", time.Now())
+	return db.db.GetAPIKeys(userID)
+}
+
+func (db instrumentedDB) GetAPIKeyByHash(hash string) (*tobab.APIKey, error) {
+	defer observeDB("GetAPIKeyByHash", time.Now())
+	return db.db.GetAPIKeyByHash(hash)
+}
+
+func (db instrumentedDB) SetAPIKey(a tobab.APIKey) error {
+	defer observeDB("SetAPIKey", time.Now())
+	return db.db.SetAPIKey(a)
+}
+
+func (db instrumentedDB) DeleteAPIKey(id string) error {
+	defer observeDB("DeleteAPIKey", time.Now())
+	return db.db.DeleteAPIKey(id)
+}
+
+func (db instrumentedDB) GetAccessRules() ([]tobab.AccessRule, error) {
+	defer observeDB("GetAccessRules", time.Now())
+	return db.db.GetAccessRules()
+}
+
+func (db instrumentedDB) SetAccessRule(r tobab.AccessRule) error {
+	defer observeDB("SetAccessRule", time.Now())
+	return db.db.SetAccessRule(r)
+}
+
+func (db instrumentedDB) DeleteAccessRule(id string) error {
+	defer observeDB("DeleteAccessRule", time.Now())
+	return db.db.DeleteAccessRule(id)
+}
+
+func (db instrumentedDB) GetGroups() ([]tobab.Group, error) {
+	defer observeDB("GetGroups", time.Now())
+	return db.db.GetGroups()
+}
+
+func (db instrumentedDB) GetGroup(id string) (*tobab.Group, error) {
+	defer observeDB("GetGroup", time.Now())
+	return db.db.GetGroup(id)
+}
+
+func (db instrumentedDB) SetGroup(g tobab.Group) error {
+	defer observeDB("SetGroup", time.Now())
+	return db.db.SetGroup(g)
+}
+
+func (db instrumentedDB) DeleteGroup(id string) error {
+	defer observeDB("DeleteGroup", time.Now())
+	return db.db.DeleteGroup(id)
+}
+
+func (db instrumentedDB) GetOIDCClients() ([]tobab.OIDCClient, error) {
+	defer observeDB("GetOIDCClients", time.Now())
+	return db.db.GetOIDCClients()
+}
+
+func (db instrumentedDB) GetOIDCClient(id string) (*tobab.OIDCClient, error) {
+	defer observeDB("GetOIDCClient", time.Now())
+	return db.db.GetOIDCClient(id)
+}
+
+func (db instrumentedDB) SetOIDCClient(cl tobab.OIDCClient) error {
+	defer observeDB("SetOIDCClient", time.Now())
+	return db.db.SetOIDCClient(cl)
+}
+
+func (db instrumentedDB) DeleteOIDCClient(id string) error {
+	defer observeDB("DeleteOIDCClient", time.Now())
+	return db.db.DeleteOIDCClient(id)
+}
+
+func (db instrumentedDB) GetInvites() ([]tobab.Invite, error) {
+	defer observeDB("GetInvites", time.Now())
+	return db.db.GetInvites()
+}
+
+func (db instrumentedDB) GetInviteByHash(hash string) (*tobab.Invite, error) {
+	defer observeDB("GetInviteByHash", time.Now())
+	return db.db.GetInviteByHash(hash)
+}
+
+func (db instrumentedDB) SetInvite(inv tobab.Invite) error {
+	defer observeDB("SetInvite", time.Now())
+	return db.db.SetInvite(inv)
+}
+
+func (db instrumentedDB) DeleteInvite(id string) error {
+	defer observeDB("DeleteInvite", time.Now())
+	return db.db.DeleteInvite(id)
+}
+
+func (db instrumentedDB) GetHosts() ([]tobab.Host, error) {
+	defer observeDB("GetHosts", time.Now())
+	return db.db.GetHosts()
+}
+
+func (db instrumentedDB) GetHost(name string) (*tobab.Host, error) {
+	defer observeDB("GetHost", time.Now())
+	return db.db.GetHost(name)
+}
+
+func (db instrumentedDB) SetHost(h tobab.Host) error {
+	defer observeDB("SetHost", time.Now())
+	return db.db.SetHost(h)
+}
+
+func (db instrumentedDB) DeleteHost(name string) error {
+	defer observeDB("DeleteHost", time.Now())
+	return db.db.DeleteHost(name)
+}
+
+func (db instrumentedDB) GetAccessRequests() ([]tobab.AccessRequest, error) {
+	defer observeDB("GetAccessRequests", time.Now())
+	return db.db.GetAccessRequests()
+}
+
+func (db instrumentedDB) GetAccessRequestsByUser(userID []byte) ([]tobab.AccessRequest, error) {
+	defer observeDB("GetAccessRequestsByUser", time.Now())
+	return db.db.GetAccessRequestsByUser(userID)
+}
+
+func (db instrumentedDB) GetAccessRequest(id string) (*tobab.AccessRequest, error) {
+	defer observeDB("GetAccessRequest", time.Now())
+	return db.db.GetAccessRequest(id)
+}
+
+func (db instrumentedDB) SetAccessRequest(r tobab.AccessRequest) error {
+	defer observeDB("SetAccessRequest", time.Now())
+	return db.db.SetAccessRequest(r)
+}
+
+func (db instrumentedDB) AddAuditEvent(e tobab.AuditEvent) error {
+	defer observeDB("AddAuditEvent", time.Now())
+	return db.db.AddAuditEvent(e)
+}
+
+func (db instrumentedDB) GetAuditEvents(f tobab.AuditFilter) ([]tobab.AuditEvent, error) {
+	defer observeDB("GetAuditEvents", time.Now())
+	return db.db.GetAuditEvents(f)
+}
+
+func (db instrumentedDB) Close() {
+	db.db.Close()
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gnur/tobab"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestVerifyMetricsHostLabel(t *testing.T) {
+	app, srv := newTestServer(t)
+	b := newBrowser(t, srv.URL)
+
+	if err := app.db.SetHost(tobab.Host{Name: "secure.example.com", Policy: tobab.HOST_POLICY_PRIVATE}); err != nil {
+		t.Fatal(err)
+	}
+
+	verify := func(host string) {
+		t.Helper()
+		b.do("GET", "/verify", nil, http.Header{"X-Forwarded-Host": {host}, "X-Forwarded-Uri": {"/"}})
+	}
+
+	//the series of the accepted host and other exist after the first decisions
+	verify("secure.example.com")
+	verify("first.example.net")
+	accepted := testutil.ToFloat64(verifyDecisions.WithLabelValues("secure.example.com", VERIFY_REDIRECT))
+	other := testutil.ToFloat64(verifyDecisions.WithLabelValues(METRIC_HOST_OTHER, VERIFY_REDIRECT))
+	series := testutil.CollectAndCount(verifyDecisions)
+
+	verify("secure.example.com")
+	for _, h := range []string{"scan1.example.net", "scan2.example.net", "scan3.example.net"} {
+		verify(h)
+	}
+
+	if got := testutil.CollectAndCount(verifyDecisions); got != series {
+		t.Errorf("verify for unknown hosts created %d new series", got-series)
+	}
+	if got := testutil.ToFloat64(verifyDecisions.WithLabelValues("secure.example.com", VERIFY_REDIRECT)); got != accepted+1 {
+		t.Errorf("decisions for accepted host = %v, want %v", got, accepted+1)
+	}
+	if got := testutil.ToFloat64(verifyDecisions.WithLabelValues(METRIC_HOST_OTHER, VERIFY_REDIRECT)); got != other+3 {
+		t.Errorf("decisions for other hosts = %v, want %v", got, other+3)
+	}
+}
@@ -12,17 +12,73 @@ const COOKIE_NAME = "X-Tobab-Session-ID"
 func (app *Tobab) getSessionMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 
+		//API key requests are stateless, don't create a session for every call
+		if _, ok := apiKeyFromRequest(c); ok {
+			return
+		}
+		//envoy asks about requests to other hosts, their cookie is read by the ext_authz handler itself
+		if extAuthzPath(c.Request.URL.Path) {
+			return
+		}
+
 		//Ignore error, empty string will result in error when retrieving session
 		sessID, _ := c.Cookie(COOKIE_NAME)
 		session := app.getSession(sessID)
 
+		//remember where the session is used from, for the sessions page
+		ip, ua := c.ClientIP(), c.Request.UserAgent()
+		if session.IP != ip || session.UserAgent != ua {
+			session.IP = ip
+			session.UserAgent = ua
+			err := app.db.SetSession(*session)
+			if err != nil {
+				app.logger.Error("failed to save session", "error", err)
+			}
+		}
+
+		//the user gained privileges since the last request of this session
+		if _, ok := session.Vals[ROTATE_KEY]; ok {
+			delete(session.Vals, ROTATE_KEY)
+			err := app.rotateSession(c, session)
+			if err != nil {
+				app.logger.Error("failed to rotate session", "error", err)
+			}
+		}
+
 		user, err := app.db.GetUser(session.UserID)
 		if err == nil && user != nil {
 			c.Header("X-Tobab-User", user.Name)
 		}
 
-		c.SetCookie(COOKIE_NAME, session.ID, int(app.defaultAge.Seconds()), "/", app.config.CookieScope, true, true)
+		app.setSessionCookie(c, session.ID)
 		c.Set("SESSION_ID", session.ID)
+		c.Set("CSRF_TOKEN", session.Vals["csrf"])
+	}
+}
+
+func (app *Tobab) authenticatedMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sess := app.getSession(c.GetString("SESSION_ID"))
+
+		if sess.State != "authenticated" {
+			c.Redirect(http.StatusTemporaryRedirect, "/")
+			c.Abort()
+			return
+		}
+
+		user, err := app.db.GetUser(sess.UserID)
+		if err != nil {
+			app.logger.Error("failed to retrieve user from session", "error", err)
+			c.Redirect(http.StatusTemporaryRedirect, "/")
+			c.Abort()
+			return
+		}
+
+		if user.Disabled {
+			c.Redirect(http.StatusTemporaryRedirect, "/")
+			c.Abort()
+			return
+		}
 	}
 }
 
@@ -46,7 +102,7 @@ func (app *Tobab) adminMiddleware() gin.HandlerFunc {
 			return
 		}
 
-		if !user.Admin {
+		if !user.Admin || user.Disabled {
 			c.Redirect(http.StatusTemporaryRedirect, "/")
 			c.Abort()
 			return
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// VERIFY_MODE_NGINX makes /verify answer with status codes only, nginx auth_request can't follow redirects
+const (
+	VERIFY_MODE_NGINX  = "nginx"
+	VERIFY_MODE_HEADER = "X-Tobab-Mode"
+)
+
+// nginxMode reports whether the proxy asked for nginx auth_request compatible responses
+func nginxMode(c *gin.Context) bool {
+	return c.Query("mode") == VERIFY_MODE_NGINX || c.GetHeader(VERIFY_MODE_HEADER) == VERIFY_MODE_NGINX
+}
+
+// forwardedRequest returns the original request the proxy asks about. caddy and traefik send
+// X-Forwarded-*, nginx only knows the variables of the original request and sends X-Original-URL
+// and X-Original-Method, which fill in whatever X-Forwarded-* header is missing.
+func forwardedRequest(c *gin.Context) (host, proto, uri, method string) {
+	host = c.GetHeader("X-Forwarded-Host")
+	proto = c.GetHeader("X-Forwarded-Proto")
+	uri = c.GetHeader("X-Forwarded-Uri")
+	method = c.GetHeader("X-Forwarded-Method")
+
+	if original, err := url.Parse(c.GetHeader("X-Original-URL")); err == nil {
+		if host == "" {
+			host = original.Host
+		}
+		if proto == "" {
+			proto = original.Scheme
+		}
+		if uri == "" && original.Host != "" {
+			uri = original.RequestURI()
+		}
+	}
+	if method == "" {
+		method = c.GetHeader("X-Original-Method")
+	}
+	return host, proto, uri, method
+}
+
+func (app *Tobab) setNginxRoutes(r *gin.Engine) {
+	//nginx sends unauthenticated users here with the page they wanted in rd, the index page stores it for after the login
+	r.GET("/login", func(c *gin.Context) {
+		//nginx can't escape $request_uri, so rd can be an unescaped url that runs until the end of the query
+		rd := c.Query("rd")
+		if raw, ok := strings.CutPrefix(c.Request.URL.RawQuery, "rd="); ok && strings.Contains(raw, "://") {
+			rd = raw
+		}
+
+		target := "/"
+		if rd != "" {
+			target += "?rd=" + url.QueryEscape(rd)
+		}
+		c.Redirect(http.StatusFound, target)
+	})
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gnur/tobab"
+	"github.com/gnur/tobab/sqlite"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+func newTestServer(t *testing.T) (*Tobab, *httptest.Server) {
+	app := newTestApp(t)
+	return app, serveTestApp(t, app)
+}
+
+// newTestApp returns a tobab on an empty database, serveTestApp starts serving it
+func newTestApp(t *testing.T) *Tobab {
+	db, err := sqlite.New(filepath.Join(t.TempDir(), "tobab.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+	templates, err := loadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := &Tobab{
+		config:      tobab.Config{Hostname: "login.example.com", CookieScope: "example.com"},
+		logger:      slog.New(slog.NewTextHandler(io.Discard, nil)),
+		fqdn:        "https://login.example.com",
+		db:          db,
+		defaultAge:  time.Hour,
+		maxAge:      time.Hour,
+		templates:   templates,
+		jwtAge:      time.Minute,
+		keyRotation: time.Hour,
+		jwtHeader:   "X-Tobab-Token",
+	}
+	app.rotateSigningKeys()
+	app.webauthn, err = webauthn.New(&webauthn.Config{
+		RPDisplayName: "example login",
+		RPID:          "example.com",
+		RPOrigins:     []string{app.fqdn},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return app
+}
+
+func serveTestApp(t *testing.T, app *Tobab) *httptest.Server {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	if err := app.setTrustedProxies(r); err != nil {
+		t.Fatal(err)
+	}
+	r.SetHTMLTemplate(app.templates)
+	r.Use(app.metricsMiddleware())
+	r.Use(app.getSessionMiddleware())
+	r.Use(app.csrfMiddleware())
+	app.setTobabRoutes(r)
+
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// nginx does what the snippet in the README configures: an auth_request subrequest to /verify?mode=nginx
+// with the original url and method, and a redirect to /login for a 401
+type fakeNginx struct {
+	t      *testing.T
+	tobab  string
+	client *http.Client
+	cookie *http.Cookie
+}
+
+func (n *fakeNginx) get(url string, header http.Header) *http.Response {
+	n.t.Helper()
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		n.t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if n.cookie != nil {
+		req.AddCookie(n.cookie)
+	}
+	res, err := n.client.Do(req)
+	if err != nil {
+		n.t.Fatal(err)
+	}
+	res.Body.Close()
+	for _, c := range res.Cookies() {
+		if c.Name == COOKIE_NAME {
+			n.cookie = c
+		}
+	}
+	return res
+}
+
+func (n *fakeNginx) authRequest(original string) *http.Response {
+	return n.get(n.tobab+"/verify?mode=nginx", http.Header{
+		"X-Original-Url":    {original},
+		"X-Original-Method": {"GET"},
+	})
+}
+
+func TestNginxAuthRequest(t *testing.T) {
+	app, srv := newTestServer(t)
+	nginx := &fakeNginx{
+		t:     t,
+		tobab: srv.URL,
+		client: &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}},
+	}
+
+	for _, h := range []string{"secure.example.com", "other.example.com"} {
+		if err := app.db.SetHost(tobab.Host{Name: h, Policy: tobab.HOST_POLICY_PRIVATE}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	alice := tobab.User{ID: []byte("alice"), Name: "alice", AccessibleHosts: []string{"secure.example.com"}}
+	if err := app.db.SetUser(alice); err != nil {
+		t.Fatal(err)
+	}
+
+	original := "https://secure.example.com/app/?tab=a&page=2"
+
+	res := nginx.authRequest(original)
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("auth_request without session: got %d, want 401", res.StatusCode)
+	}
+
+	//error_page 401 = @tobab_login, which doesn't escape $request_uri
+	res = nginx.get(srv.URL+"/login?rd="+original, nil)
+	if res.StatusCode != http.StatusFound {
+		t.Fatalf("/login: got %d, want 302", res.StatusCode)
+	}
+	res = nginx.get(srv.URL+res.Header.Get("Location"), nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("login page: got %d, want 200", res.StatusCode)
+	}
+	sess, err := app.db.GetSession(nginx.cookie.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sess.Vals["redirect_url"] != original {
+		t.Errorf("redirect after login = %q, want %q", sess.Vals["redirect_url"], original)
+	}
+
+	//the passkey login itself needs a browser, move the session to authenticated directly
+	sess.UserID = alice.ID
+	sess.FSM = setupFSM("authenticated")
+	if err := app.db.SetSession(*sess); err != nil {
+		t.Fatal(err)
+	}
+
+	res = nginx.authRequest(original)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("auth_request for granted host: got %d, want 200", res.StatusCode)
+	}
+	if got := res.Header.Get("X-Tobab-User"); got != "alice" {
+		t.Errorf("X-Tobab-User = %q, want alice", got)
+	}
+	if res.Header.Get("X-Tobab-Token") == "" {
+		t.Errorf("auth_request response has no identity token")
+	}
+
+	res = nginx.authRequest("https://other.example.com/")
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("auth_request for host without access: got %d, want 403", res.StatusCode)
+	}
+
+	//without nginx mode the same request is redirected, like caddy and traefik expect
+	res = nginx.get(srv.URL+"/verify", http.Header{"X-Original-Url": {"https://other.example.com/"}})
+	if res.StatusCode != http.StatusTemporaryRedirect {
+		t.Errorf("verify without nginx mode: got %d, want 307", res.StatusCode)
+	}
+
+	nginx.cookie = nil
+	res = nginx.get(srv.URL+"/verify", http.Header{
+		"X-Original-Url":   {original},
+		VERIFY_MODE_HEADER: {VERIFY_MODE_NGINX},
+	})
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("nginx mode by header without session: got %d, want 401", res.StatusCode)
+	}
+}
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gnur/tobab"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/lithammer/shortuuid"
+)
+
+const OIDC_CODES_KEY = "oidc_codes"
+const OIDC_CODE_AGE = time.Minute
+const OIDC_TOKEN_AGE = time.Hour
+
+// oidcCode is an issued authorization code waiting to be exchanged at the token endpoint
+type oidcCode struct {
+	ClientID    string
+	UserID      []byte
+	RedirectURI string
+	Scope       string
+	Nonce       string
+	Challenge   string
+	AuthTime    time.Time
+	Expires     time.Time
+}
+
+type oidcClaims struct {
+	Name              string   `json:"name,omitempty"`
+	PreferredUsername string   `json:"preferred_username,omitempty"`
+	Groups            []string `json:"groups,omitempty"`
+	Nonce             string   `json:"nonce,omitempty"`
+	Scope             string   `json:"scope,omitempty"`
+	AuthTime          int64    `json:"auth_time,omitempty"`
+	jwt.RegisteredClaims
+}
+
+type clientVars struct {
+	State string
+	User  tobab.User
+	CSRF  string
+
+	Clients   []tobab.OIDCClient
+	Hosts     []string
+	NewClient *tobab.OIDCClient
+	NewSecret string
+}
+
+func (app *Tobab) setOIDCRoutes(r *gin.Engine, admin *gin.RouterGroup) {
+	ll := app.logger.With("service", "oidc")
+
+	r.GET("/.well-known/openid-configuration", func(c *gin.Context) {
+		c.JSON(200, gin.H{
+			"issuer":                                app.fqdn,
+			"authorization_endpoint":                app.fqdn + "/oidc/authorize",
+			"token_endpoint":                        app.fqdn + "/oidc/token",
+			"userinfo_endpoint":                     app.fqdn + "/oidc/userinfo",
+			"jwks_uri":                              app.fqdn + "/.well-known/jwks.json",
+			"response_types_supported":              []string{"code"},
+			"grant_types_supported":                 []string{"authorization_code"},
+			"subject_types_supported":               []string{"public"},
+			"id_token_signing_alg_values_supported": []string{"ES256"},
+			"scopes_supported":                      []string{"openid", "profile", "groups"},
+			"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+			"code_challenge_methods_supported":      []string{"S256"},
+			"claims_supported":                      []string{"sub", "name", "preferred_username", "groups", "nonce", "auth_time"},
+		})
+	})
+
+	r.GET("/oidc/authorize", func(c *gin.Context) {
+		q := c.Request.URL.Query()
+
+		cl, err := app.db.GetOIDCClient(q.Get("client_id"))
+		if err != nil {
+			ll.Warn("unknown client in authorize request", "client_id", q.Get("client_id"))
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+				"msg": "unknown client",
+			})
+			return
+		}
+
+		redirectURI := q.Get("redirect_uri")
+		if !cl.AllowsRedirect(redirectURI) {
+			ll.Warn("redirect_uri not registered for client", "client_id", cl.ID, "redirect_uri", redirectURI)
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+				"msg": "invalid redirect_uri",
+			})
+			return
+		}
+
+		state := q.Get("state")
+		if q.Get("response_type") != "code" {
+			oidcRedirectError(c, redirectURI, state, "unsupported_response_type")
+			return
+		}
+
+		scope := q.Get("scope")
+		if !tobab.Contains(strings.Fields(scope), "openid") {
+			oidcRedirectError(c, redirectURI, state, "invalid_scope")
+			return
+		}
+
+		challenge := q.Get("code_challenge")
+		if challenge == "" && cl.Public() {
+			oidcRedirectError(c, redirectURI, state, "invalid_request")
+			return
+		}
+		if challenge != "" && q.Get("code_challenge_method") != "S256" {
+			oidcRedirectError(c, redirectURI, state, "invalid_request")
+			return
+		}
+
+		sess := app.getSession(c.GetString("SESSION_ID"))
+		if sess.State != "authenticated" {
+			sess.Vals["redirect_url"] = app.fqdn + c.Request.URL.RequestURI()
+			err = app.db.SetSession(*sess)
+			if err != nil {
+				ll.Error("failed to save session", "error", err)
+			}
+			ll.Info("redirecting to login", "client_id", cl.ID)
+			c.Redirect(http.StatusTemporaryRedirect, "/")
+			return
+		}
+
+		user, err := app.db.GetUser(sess.UserID)
+		if err != nil {
+			ll.Error("failed to retrieve user from session", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		if user.Disabled || !app.canAccess(user, cl.Host) {
+			ll.Warn("user has no access to client", "user", user.Name, "client_id", cl.ID, "host", cl.Host)
+			oidcRedirectError(c, redirectURI, state, "access_denied")
+			return
+		}
+
+		var authTime time.Time
+		if t, err := strconv.ParseInt(sess.Vals["auth_time"], 10, 64); err == nil {
+			authTime = time.Unix(t, 0)
+		}
+
+		code, err := randomString(32)
+		if err != nil {
+			ll.Error("failed to generate authorization code", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		err = app.storeOIDCCode(code, oidcCode{
+			ClientID:    cl.ID,
+			UserID:      user.ID,
+			RedirectURI: redirectURI,
+			Scope:       scope,
+			Nonce:       q.Get("nonce"),
+			Challenge:   challenge,
+			AuthTime:    authTime,
+			Expires:     time.Now().Add(OIDC_CODE_AGE),
+		})
+		if err != nil {
+			ll.Error("failed to store authorization code", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		ll.Info("issued authorization code", "user", user.Name, "client_id", cl.ID)
+		c.Redirect(http.StatusFound, oidcRedirectURL(redirectURI, url.Values{
+			"code":  {code},
+			"state": {state},
+		}))
+	})
+
+	r.POST("/oidc/token", func(c *gin.Context) {
+		c.Header("Cache-Control", "no-store")
+		c.Header("Pragma", "no-cache")
+
+		clientID, secret, ok := c.Request.BasicAuth()
+		if !ok {
+			clientID = c.PostForm("client_id")
+			secret = c.PostForm("client_secret")
+		}
+
+		cl, err := app.db.GetOIDCClient(clientID)
+		if err != nil || (!cl.Public() && subtle.ConstantTimeCompare([]byte(tobab.HashSecret(secret)), []byte(cl.SecretHash)) != 1) {
+			ll.Warn("invalid client credentials", "client_id", clientID)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid_client"})
+			return
+		}
+
+		if c.PostForm("grant_type") != "authorization_code" {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "unsupported_grant_type"})
+			return
+		}
+
+		code, err := app.takeOIDCCode(c.PostForm("code"))
+		if err != nil || code.ClientID != cl.ID || code.RedirectURI != c.PostForm("redirect_uri") || code.Expires.Before(time.Now()) {
+			ll.Warn("invalid authorization code", "client_id", cl.ID, "error", err)
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_grant"})
+			return
+		}
+
+		if code.Challenge != "" {
+			sum := sha256.Sum256([]byte(c.PostForm("code_verifier")))
+			if base64.RawURLEncoding.EncodeToString(sum[:]) != code.Challenge {
+				ll.Warn("invalid code_verifier", "client_id", cl.ID)
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_grant"})
+				return
+			}
+		}
+
+		user, err := app.db.GetUser(code.UserID)
+		if err != nil || user.Disabled || !app.canAccess(user, cl.Host) {
+			ll.Warn("user for authorization code is gone or lost access", "client_id", cl.ID, "error", err)
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid_grant"})
+			return
+		}
+
+		now := time.Now()
+		registered := jwt.RegisteredClaims{
+			Issuer:    app.fqdn,
+			Subject:   string(user.ID),
+			Audience:  jwt.ClaimStrings{cl.ID},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(OIDC_TOKEN_AGE)),
+		}
+
+		accessToken, err := app.signToken(oidcClaims{
+			Scope:            code.Scope,
+			RegisteredClaims: registered,
+		})
+		if err != nil {
+			ll.Error("failed to sign access token", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		idClaims := app.oidcUserClaims(user, code.Scope)
+		idClaims.Nonce = code.Nonce
+		if !code.AuthTime.IsZero() {
+			idClaims.AuthTime = code.AuthTime.Unix()
+		}
+		idClaims.RegisteredClaims = registered
+		idToken, err := app.signToken(idClaims)
+		if err != nil {
+			ll.Error("failed to sign id token", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		ll.Info("issued tokens", "user", user.Name, "client_id", cl.ID)
+		c.JSON(200, gin.H{
+			"access_token": accessToken,
+			"token_type":   "Bearer",
+			"expires_in":   int(OIDC_TOKEN_AGE.Seconds()),
+			"id_token":     idToken,
+			"scope":        code.Scope,
+		})
+	})
+
+	userinfo := func(c *gin.Context) {
+		token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok {
+			c.Header("WWW-Authenticate", `Bearer`)
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+
+		var claims oidcClaims
+		err := app.parseToken(token, &claims)
+		if err != nil || claims.Scope == "" {
+			ll.Warn("invalid access token", "error", err)
+			c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+
+		user, err := app.db.GetUser([]byte(claims.Subject))
+		if err != nil || user.Disabled {
+			ll.Warn("user for access token not found or disabled", "error", err)
+			c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+
+		info := app.oidcUserClaims(user, claims.Scope)
+		c.JSON(200, gin.H{
+			"sub":                string(user.ID),
+			"name":               info.Name,
+			"preferred_username": info.PreferredUsername,
+			"groups":             info.Groups,
+		})
+	}
+	r.GET("/oidc/userinfo", userinfo)
+	r.POST("/oidc/userinfo", userinfo)
+
+	admin.GET("/clients.html", func(c *gin.Context) {
+		app.renderClients(c, nil, "")
+	})
+
+	admin.POST("/clients/create", func(c *gin.Context) {
+		name := strings.TrimSpace(c.PostForm("name"))
+		host := strings.TrimSpace(c.PostForm("host"))
+		uris := strings.Fields(c.PostForm("redirect_uris"))
+
+		if name == "" || len(uris) == 0 {
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		for _, u := range uris {
+			parsed, err := url.Parse(u)
+			if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" || parsed.Fragment != "" {
+				app.logger.Warn("invalid redirect uri provided", "redirect_uri", u)
+				c.AbortWithStatus(http.StatusBadRequest)
+				return
+			}
+			if host == "" {
+				host = parsed.Hostname()
+			}
+		}
+
+		cl := tobab.OIDCClient{
+			ID:           shortuuid.New(),
+			Name:         name,
+			RedirectURIs: uris,
+			Host:         host,
+			Created:      time.Now(),
+		}
+
+		var secret string
+		if c.PostForm("public") == "" {
+			var err error
+			secret, err = randomString(32)
+			if err != nil {
+				app.logger.Error("failed to generate client secret", "error", err)
+				c.AbortWithStatus(http.StatusInternalServerError)
+				return
+			}
+			cl.SecretHash = tobab.HashSecret(secret)
+		}
+
+		err := app.db.SetOIDCClient(cl)
+		if err != nil {
+			app.logger.Error("failed to save client", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		//the client host has to be known before users can be granted access to it
+		app.addHost(host)
+
+		app.renderClients(c, &cl, secret)
+	})
+
+	admin.POST("/clients/delete", func(c *gin.Context) {
+		err := app.db.DeleteOIDCClient(c.Query("id"))
+		if err == tobab.ErrNotFound {
+			app.logger.Warn("invalid client provided", "id", c.Query("id"))
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			app.logger.Error("failed to delete client", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		c.Header("HX-Refresh", "true")
+		c.JSON(200, gin.H{})
+	})
+}
+
+func (app *Tobab) renderClients(c *gin.Context, newClient *tobab.OIDCClient, newSecret string) {
+	clients, err := app.db.GetOIDCClients()
+	if err != nil {
+		app.logger.Error("failed to retrieve clients from database", "error", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	sess := app.getSession(c.GetString("SESSION_ID"))
+	user, err := app.db.GetUser(sess.UserID)
+	if err != nil {
+		app.logger.Error("failed to retrieve user from session", "error", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.HTML(200, "clients.html", clientVars{
+		CSRF:      c.GetString("CSRF_TOKEN"),
+		State:     sess.State,
+		User:      *user,
+		Clients:   clients,
+		Hosts:     app.getHosts(),
+		NewClient: newClient,
+		NewSecret: newSecret,
+	})
+}
+
+// oidcUserClaims returns the user claims that are allowed by scope
+func (app *Tobab) oidcUserClaims(user *tobab.User, scope string) oidcClaims {
+	var claims oidcClaims
+	scopes := strings.Fields(scope)
+
+	if tobab.Contains(scopes, "profile") {
+		claims.Name = user.Name
+		claims.PreferredUsername = user.Name
+	}
+	if tobab.Contains(scopes, "groups") {
+		claims.Groups = []string{}
+		for _, g := range app.userGroups(user) {
+			claims.Groups = append(claims.Groups, g.Name)
+		}
+	}
+	return claims
+}
+
+// storeOIDCCode saves an authorization code and drops all expired codes
+func (app *Tobab) storeOIDCCode(code string, data oidcCode) error {
+	app.codesMu.Lock()
+	defer app.codesMu.Unlock()
+
+	codes := map[string]oidcCode{}
+	err := app.db.KVGet(OIDC_CODES_KEY, &codes)
+	if err != nil && err != tobab.ErrNotFound {
+		return err
+	}
+
+	for k, v := range codes {
+		if v.Expires.Before(time.Now()) {
+			delete(codes, k)
+		}
+	}
+	codes[tobab.HashSecret(code)] = data
+
+	return app.db.KVSet(OIDC_CODES_KEY, codes)
+}
+
+// takeOIDCCode returns the data for an authorization code and removes it so it can only be used once
+func (app *Tobab) takeOIDCCode(code string) (*oidcCode, error) {
+	app.codesMu.Lock()
+	defer app.codesMu.Unlock()
+
+	codes := map[string]oidcCode{}
+	err := app.db.KVGet(OIDC_CODES_KEY, &codes)
+	if err != nil {
+		return nil, err
+	}
+
+	data, ok := codes[tobab.HashSecret(code)]
+	if !ok {
+		return nil, tobab.ErrNotFound
+	}
+	delete(codes, tobab.HashSecret(code))
+
+	return &data, app.db.KVSet(OIDC_CODES_KEY, codes)
+}
+
+func oidcRedirectURL(redirectURI string, params url.Values) string {
+	u, _ := url.Parse(redirectURI)
+	q := u.Query()
+	for k, v := range params {
+		if len(v) > 0 && v[0] != "" {
+			q[k] = v
+		}
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+func oidcRedirectError(c *gin.Context, redirectURI, state, code string) {
+	c.Redirect(http.StatusFound, oidcRedirectURL(redirectURI, url.Values{
+		"error": {code},
+		"state": {state},
+	}))
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gnur/tobab"
+)
+
+const testRedirect = "https://app.example.com/callback"
+
+// oidcTestServer registers a confidential client "app" with secret "s3cret", a public client "spa",
+// and alice who can access the host of the clients and mallory who can't
+func oidcTestServer(t *testing.T) (*Tobab, string) {
+	app, srv := newTestServer(t)
+
+	if err := app.db.SetHost(tobab.Host{Name: "app.example.com", Policy: tobab.HOST_POLICY_PRIVATE}); err != nil {
+		t.Fatal(err)
+	}
+	clients := []tobab.OIDCClient{
+		{ID: "app", Name: "app", SecretHash: tobab.HashSecret("s3cret"), RedirectURIs: []string{testRedirect}, Host: "app.example.com"},
+		{ID: "spa", Name: "spa", RedirectURIs: []string{testRedirect}, Host: "app.example.com"},
+	}
+	for _, cl := range clients {
+		if err := app.db.SetOIDCClient(cl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	users := []tobab.User{
+		{ID: []byte("alice"), Name: "alice", AccessibleHosts: []string{"app.example.com"}},
+		{ID: []byte("mallory"), Name: "mallory"},
+	}
+	for _, u := range users {
+		if err := app.db.SetUser(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return app, srv.URL
+}
+
+func authorizeQuery(client string, extra url.Values) string {
+	q := url.Values{
+		"client_id":     {client},
+		"redirect_uri":  {testRedirect},
+		"response_type": {"code"},
+		"scope":         {"openid profile"},
+		"state":         {"xyz"},
+	}
+	for k, v := range extra {
+		q[k] = v
+	}
+	return "/oidc/authorize?" + q.Encode()
+}
+
+// authorize logs b in as alice and returns a fresh authorization code for client
+func authorize(t *testing.T, b *browser, client string, extra url.Values) string {
+	t.Helper()
+	res, _ := b.do("GET", authorizeQuery(client, extra), nil, nil)
+	loc, err := url.Parse(res.Header.Get("Location"))
+	if res.StatusCode != http.StatusFound || err != nil || loc.Query().Get("code") == "" {
+		t.Fatalf("authorize: got %d to %q, want a redirect with a code", res.StatusCode, res.Header.Get("Location"))
+	}
+	return loc.Query().Get("code")
+}
+
+// exchange posts form to the token endpoint and decodes the response
+func exchange(t *testing.T, b *browser, form url.Values, header http.Header) (int, map[string]any) {
+	t.Helper()
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res, body := b.do("POST", "/oidc/token", strings.NewReader(form.Encode()), header)
+	out := map[string]any{}
+	json.Unmarshal([]byte(body), &out)
+	return res.StatusCode, out
+}
+
+func basicAuth(id, secret string) http.Header {
+	return http.Header{"Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte(id+":"+secret))}}
+}
+
+func TestOIDCAuthorize(t *testing.T) {
+	app, base := oidcTestServer(t)
+	alice, _ := app.db.GetUserByName("alice")
+	mallory, _ := app.db.GetUserByName("mallory")
+
+	tests := []struct {
+		name   string
+		user   *tobab.User
+		query  string
+		status int
+		error  string
+	}{
+		{"unknown client", alice, authorizeQuery("unknown", nil), http.StatusBadRequest, ""},
+		{"unregistered redirect_uri", alice, authorizeQuery("app", url.Values{"redirect_uri": {"https://evil.com/callback"}}), http.StatusBadRequest, ""},
+		{"public client without pkce", alice, authorizeQuery("spa", nil), http.StatusFound, "invalid_request"},
+		{"plain pkce", alice, authorizeQuery("spa", url.Values{"code_challenge": {"abc"}, "code_challenge_method": {"plain"}}), http.StatusFound, "invalid_request"},
+		{"no openid scope", alice, authorizeQuery("app", url.Values{"scope": {"profile"}}), http.StatusFound, "invalid_scope"},
+		{"user without access to the client", mallory, authorizeQuery("app", nil), http.StatusFound, "access_denied"},
+		{"not logged in", nil, authorizeQuery("app", nil), http.StatusTemporaryRedirect, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newBrowser(t, base)
+			if tt.user != nil {
+				b.login(app, *tt.user)
+			}
+			res, _ := b.do("GET", tt.query, nil, nil)
+			if res.StatusCode != tt.status {
+				t.Fatalf("got %d, want %d", res.StatusCode, tt.status)
+			}
+			loc := res.Header.Get("Location")
+			if tt.status == http.StatusBadRequest && loc != "" {
+				t.Errorf("invalid client or redirect_uri redirected to %q", loc)
+			}
+			if tt.error == "" {
+				return
+			}
+			u, err := url.Parse(loc)
+			if err != nil || !strings.HasPrefix(loc, testRedirect) || u.Query().Get("error") != tt.error || u.Query().Get("state") != "xyz" {
+				t.Errorf("redirected to %q, want %s with error %s and the state", loc, testRedirect, tt.error)
+			}
+			if u.Query().Get("code") != "" {
+				t.Errorf("error redirect carries a code")
+			}
+		})
+	}
+}
+
+func TestOIDCToken(t *testing.T) {
+	app, base := oidcTestServer(t)
+	alice, _ := app.db.GetUserByName("alice")
+	b := newBrowser(t, base)
+	b.login(app, *alice)
+
+	form := func(code string) url.Values {
+		return url.Values{"grant_type": {"authorization_code"}, "code": {code}, "redirect_uri": {testRedirect}}
+	}
+
+	code := authorize(t, b, "app", nil)
+	status, out := exchange(t, b, form(code), basicAuth("app", "s3cret"))
+	if status != http.StatusOK || out["access_token"] == nil || out["id_token"] == nil {
+		t.Fatalf("token: got %d %v, want tokens", status, out)
+	}
+
+	//every code is single use, also when the first exchange succeeded
+	if status, out := exchange(t, b, form(code), basicAuth("app", "s3cret")); status != http.StatusBadRequest || out["error"] != "invalid_grant" {
+		t.Errorf("reused code: got %d %v, want invalid_grant", status, out)
+	}
+
+	code = authorize(t, b, "app", nil)
+	wrong := form(code)
+	wrong.Set("redirect_uri", "https://app.example.com/other")
+	if status, out := exchange(t, b, wrong, basicAuth("app", "s3cret")); status != http.StatusBadRequest || out["error"] != "invalid_grant" {
+		t.Errorf("mismatched redirect_uri: got %d %v, want invalid_grant", status, out)
+	}
+	if status, _ := exchange(t, b, form(code), basicAuth("app", "s3cret")); status != http.StatusBadRequest {
+		t.Errorf("code was usable after a failed exchange: got %d", status)
+	}
+
+	code = authorize(t, b, "app", nil)
+	if status, out := exchange(t, b, form(code), basicAuth("app", "wrong")); status != http.StatusUnauthorized || out["error"] != "invalid_client" {
+		t.Errorf("wrong client secret: got %d %v, want invalid_client", status, out)
+	}
+	post := form(authorize(t, b, "app", nil))
+	post.Set("client_id", "app")
+	post.Set("client_secret", "wrong")
+	if status, out := exchange(t, b, post, nil); status != http.StatusUnauthorized || out["error"] != "invalid_client" {
+		t.Errorf("wrong client secret in form: got %d %v, want invalid_client", status, out)
+	}
+
+	//a code issued to one client can't be exchanged by another
+	code = authorize(t, b, "app", nil)
+	other := form(code)
+	other.Set("client_id", "spa")
+	if status, _ := exchange(t, b, other, nil); status != http.StatusBadRequest {
+		t.Errorf("code of another client: got %d, want 400", status)
+	}
+
+	verifier := "a-verifier-that-is-long-enough-for-pkce-0123456789"
+	sum := sha256.Sum256([]byte(verifier))
+	pkce := url.Values{"code_challenge": {base64.RawURLEncoding.EncodeToString(sum[:])}, "code_challenge_method": {"S256"}}
+
+	spa := form(authorize(t, b, "spa", pkce))
+	spa.Set("client_id", "spa")
+	spa.Set("code_verifier", "not-the-verifier")
+	if status, out := exchange(t, b, spa, nil); status != http.StatusBadRequest || out["error"] != "invalid_grant" {
+		t.Errorf("wrong code_verifier: got %d %v, want invalid_grant", status, out)
+	}
+	spa = form(authorize(t, b, "spa", pkce))
+	spa.Set("client_id", "spa")
+	if status, _ := exchange(t, b, spa, nil); status != http.StatusBadRequest {
+		t.Errorf("missing code_verifier: got %d, want 400", status)
+	}
+	spa.Set("code", authorize(t, b, "spa", pkce))
+	spa.Set("code_verifier", verifier)
+	if status, out := exchange(t, b, spa, nil); status != http.StatusOK {
+		t.Errorf("public client with code_verifier: got %d %v, want 200", status, out)
+	}
+
+	err := app.storeOIDCCode("expired-code", oidcCode{
+		ClientID:    "app",
+		UserID:      alice.ID,
+		RedirectURI: testRedirect,
+		Scope:       "openid",
+		Expires:     time.Now().Add(-time.Second),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, out := exchange(t, b, form("expired-code"), basicAuth("app", "s3cret")); status != http.StatusBadRequest || out["error"] != "invalid_grant" {
+		t.Errorf("expired code: got %d %v, want invalid_grant", status, out)
+	}
+}
+
+func TestOIDCUserinfo(t *testing.T) {
+	app, base := oidcTestServer(t)
+	alice, _ := app.db.GetUserByName("alice")
+	b := newBrowser(t, base)
+	b.login(app, *alice)
+
+	code := authorize(t, b, "app", nil)
+	status, out := exchange(t, b, url.Values{"grant_type": {"authorization_code"}, "code": {code}, "redirect_uri": {testRedirect}}, basicAuth("app", "s3cret"))
+	if status != http.StatusOK {
+		t.Fatalf("token: got %d %v", status, out)
+	}
+	identity, err := app.signIdentityToken(alice, nil, "app.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"access token", out["access_token"].(string), http.StatusOK},
+		{"id token", out["id_token"].(string), http.StatusUnauthorized},
+		{"forward auth token", identity, http.StatusUnauthorized},
+		{"garbage", "not-a-token", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, body := b.do("GET", "/oidc/userinfo", nil, http.Header{"Authorization": {"Bearer " + tt.token}})
+			if res.StatusCode != tt.want {
+				t.Fatalf("got %d, want %d", res.StatusCode, tt.want)
+			}
+			if tt.want == http.StatusOK && !strings.Contains(body, `"sub":"alice"`) {
+				t.Errorf("userinfo %s, want the claims of alice", body)
+			}
+		})
+	}
+
+	if res, _ := b.do("GET", "/oidc/userinfo", nil, nil); res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("userinfo without token: got %d, want 401", res.StatusCode)
+	}
+}
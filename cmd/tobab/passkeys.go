@@ -0,0 +1,287 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gnur/tobab"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// PASSKEY_TIMEOUT is how long a logged in user has to finish adding a passkey
+const PASSKEY_TIMEOUT = 5 * time.Minute
+
+// ADD_PASSKEY_KEY holds the unix time an add passkey ceremony of the session ends, the session stays authenticated during the ceremony
+const ADD_PASSKEY_KEY = "add_passkey"
+
+type passkey struct {
+	ID       string
+	Name     string
+	Model    string
+	Created  time.Time
+	LastUsed time.Time
+}
+
+type passkeyVars struct {
+	State string
+	User  *tobab.User
+	CSRF  string
+
+	Passkeys []passkey
+}
+
+func (app *Tobab) setPasskeyRoutes(r *gin.Engine) {
+	pklog := app.logger.With("method", "passkey")
+
+	keys := r.Group("/passkeys")
+	keys.Use(app.authenticatedMiddleware())
+
+	keys.GET("/index.html", func(c *gin.Context) {
+		sess := app.getSession(c.GetString("SESSION_ID"))
+		user, err := app.db.GetUser(sess.UserID)
+		if err != nil {
+			pklog.Error("failed to retrieve user from session", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		var passkeys []passkey
+		for _, cred := range user.Creds {
+			id := tobab.CredentialID(cred)
+			info := user.CredInfo[id]
+			pk := passkey{
+				ID:       id,
+				Name:     info.Name,
+				Model:    authenticatorName(cred.Authenticator.AAGUID),
+				Created:  info.Created,
+				LastUsed: info.LastUsed,
+			}
+			if pk.Name == "" {
+				pk.Name = pk.Model
+			}
+			passkeys = append(passkeys, pk)
+		}
+		sort.SliceStable(passkeys, func(i, j int) bool {
+			return passkeys[i].Created.Before(passkeys[j].Created)
+		})
+
+		c.HTML(200, "passkeys.html", passkeyVars{
+			CSRF:     c.GetString("CSRF_TOKEN"),
+			State:    sess.State,
+			User:     user,
+			Passkeys: passkeys,
+		})
+	})
+
+	keys.POST("/rename", func(c *gin.Context) {
+		id := c.Query("id")
+		name := strings.TrimSpace(c.PostForm("name"))
+		if name == "" {
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		sess := app.getSession(c.GetString("SESSION_ID"))
+		user, err := app.db.GetUser(sess.UserID)
+		if err != nil {
+			pklog.Error("failed to retrieve user from session", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		if !hasCredential(user, id) {
+			pklog.Warn("invalid passkey provided", "user", user.Name, "id", id)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		if user.CredInfo == nil {
+			user.CredInfo = make(map[string]tobab.CredentialInfo)
+		}
+		info := user.CredInfo[id]
+		info.Name = name
+		user.CredInfo[id] = info
+
+		err = app.db.SetUser(*user)
+		if err != nil {
+			pklog.Error("failed to save user", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		c.Header("HX-Refresh", "true")
+		c.JSON(200, gin.H{})
+	})
+
+	keys.POST("/delete", func(c *gin.Context) {
+		id := c.Query("id")
+
+		sess := app.getSession(c.GetString("SESSION_ID"))
+		user, err := app.db.GetUser(sess.UserID)
+		if err != nil {
+			pklog.Error("failed to retrieve user from session", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		if len(user.Creds) <= 1 {
+			pklog.Warn("user tried to delete their last passkey", "user", user.Name)
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+				"msg": "the last passkey can not be deleted",
+			})
+			return
+		}
+
+		if !user.RemoveCredential(id) {
+			pklog.Warn("invalid passkey provided", "user", user.Name, "id", id)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		err = app.db.SetUser(*user)
+		if err != nil {
+			pklog.Error("failed to save user", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		app.audit(c, tobab.AuditEvent{
+			Type:   tobab.AUDIT_PASSKEY_DELETED,
+			Actor:  user.Name,
+			Target: user.Name,
+			Detail: id,
+		})
+		c.Header("HX-Refresh", "true")
+		c.JSON(200, gin.H{})
+	})
+
+	r.POST("/passkey/add/start", func(c *gin.Context) {
+		sess := app.getSession(c.GetString("SESSION_ID"))
+
+		if sess.FSM.Current() != "authenticated" {
+			pklog.Warn("invalid source state for this request", "state", sess.FSM.Current())
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		user, err := app.db.GetUser(sess.UserID)
+		if err != nil {
+			pklog.Error("failed to retrieve user from session", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		var exclusions []protocol.CredentialDescriptor
+		for _, cred := range user.Creds {
+			exclusions = append(exclusions, cred.Descriptor())
+		}
+
+		authSelect := protocol.AuthenticatorSelection{
+			RequireResidentKey: protocol.ResidentKeyRequired(),
+			ResidentKey:        protocol.ResidentKeyRequirementRequired,
+			UserVerification:   protocol.VerificationPreferred,
+		}
+
+		options, session, err := app.webauthn.BeginRegistration(user,
+			webauthn.WithAuthenticatorSelection(authSelect),
+			webauthn.WithConveyancePreference(protocol.PreferNoAttestation),
+			webauthn.WithExclusions(exclusions),
+		)
+		if err != nil {
+			pklog.Error("failed to start webauthn registration", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		sess.Data = session
+		sess.Vals[ADD_PASSKEY_KEY] = strconv.FormatInt(time.Now().Add(PASSKEY_TIMEOUT).Unix(), 10)
+
+		err = app.db.SetSession(*sess)
+		if err != nil {
+			pklog.Error("failed to save session", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		c.AbortWithStatusJSON(http.StatusOK, options)
+	})
+
+	r.POST("/passkey/add/finish", func(c *gin.Context) {
+		sess := app.getSession(c.GetString("SESSION_ID"))
+
+		if sess.FSM.Current() != "authenticated" || !addingPasskey(sess) {
+			pklog.Warn("no add passkey ceremony in progress", "state", sess.FSM.Current())
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		//whatever happens, the ceremony is over
+		defer func() {
+			sess.Data = &webauthn.SessionData{}
+			delete(sess.Vals, ADD_PASSKEY_KEY)
+			app.db.SetSession(*sess)
+		}()
+
+		if c.Query("cancel") != "" {
+			c.AbortWithStatus(http.StatusOK)
+			return
+		}
+
+		resp, err := protocol.ParseCredentialCreationResponseBody(c.Request.Body)
+		if err != nil {
+			pklog.Error("failed to parse credential body", "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		user, err := app.db.GetUser(sess.UserID)
+		if err != nil {
+			pklog.Error("failed to retrieve user from session", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		credential, err := app.webauthn.CreateCredential(user, *sess.Data, resp)
+		if err != nil {
+			pklog.Error("failed to create credential", "error", err)
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+				"msg": "failed to add passkey",
+			})
+			return
+		}
+
+		user.AddCredential(*credential, authenticatorName(credential.Authenticator.AAGUID))
+		err = app.db.SetUser(*user)
+		if err != nil {
+			pklog.Error("failed to store credential with user", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		app.audit(c, tobab.AuditEvent{
+			Type:   tobab.AUDIT_PASSKEY_ADDED,
+			Actor:  user.Name,
+			Target: user.Name,
+			Detail: tobab.CredentialID(*credential),
+		})
+		c.AbortWithStatus(http.StatusOK)
+	})
+}
+
+// addingPasskey reports whether the add passkey ceremony of sess was started and has not timed out
+func addingPasskey(sess *tobab.Session) bool {
+	ends, err := strconv.ParseInt(sess.Vals[ADD_PASSKEY_KEY], 10, 64)
+	return err == nil && time.Now().Before(time.Unix(ends, 0))
+}
+
+func hasCredential(user *tobab.User, id string) bool {
+	for _, cred := range user.Creds {
+		if tobab.CredentialID(cred) == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gnur/tobab"
+)
+
+func TestAddPasskeyKeepsLogin(t *testing.T) {
+	app, srv := newTestServer(t)
+	b := newBrowser(t, srv.URL)
+
+	if err := app.db.SetHost(tobab.Host{Name: "secure.example.com", Policy: tobab.HOST_POLICY_PRIVATE}); err != nil {
+		t.Fatal(err)
+	}
+	alice := tobab.User{ID: []byte("alice"), Name: "alice", AccessibleHosts: []string{"secure.example.com"}}
+	if err := app.db.SetUser(alice); err != nil {
+		t.Fatal(err)
+	}
+	sess := b.login(app, alice)
+	csrf := http.Header{CSRF_HEADER: {sess.Vals["csrf"]}}
+
+	verify := func() int {
+		t.Helper()
+		res, _ := b.do("GET", "/verify", nil, http.Header{
+			"X-Forwarded-Host": {"secure.example.com"},
+			"X-Forwarded-Uri":  {"/"},
+		})
+		return res.StatusCode
+	}
+
+	res, _ := b.do("POST", "/passkey/add/start", nil, csrf)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("add start: got %d, want 200", res.StatusCode)
+	}
+
+	stored, err := app.db.GetSession(sess.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.State != "authenticated" {
+		t.Errorf("session state during add ceremony = %q, want authenticated", stored.State)
+	}
+	if stored.Expires.Before(time.Now().Add(app.defaultAge - time.Minute)) {
+		t.Errorf("add ceremony shortened the session to %s", stored.Expires)
+	}
+	if got := verify(); got != http.StatusOK {
+		t.Errorf("verify during add ceremony: got %d, want 200", got)
+	}
+	res, _ = b.do("GET", "/passkeys/index.html", nil, nil)
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("passkeys page during add ceremony: got %d, want 200", res.StatusCode)
+	}
+
+	res, _ = b.do("POST", "/passkey/add/finish?cancel=true", nil, csrf)
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("add cancel: got %d, want 200", res.StatusCode)
+	}
+	res, _ = b.do("POST", "/passkey/add/finish?cancel=true", nil, csrf)
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("add finish without ceremony: got %d, want 400", res.StatusCode)
+	}
+	if got := verify(); got != http.StatusOK {
+		t.Errorf("verify after add ceremony: got %d, want 200", got)
+	}
+}
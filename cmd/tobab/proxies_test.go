@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	tests := []struct {
+		proxy string
+		want  string
+	}{
+		{"10.0.0.1", "10.0.0.1/32"},
+		{"::1", "::1/128"},
+		{"fd00::1", "fd00::1/128"},
+		{"10.0.0.0/8", "10.0.0.0/8"},
+		{"fd00::/8", "fd00::/8"},
+		{"proxy.example.com", ""},
+		{"10.0.0.1/33", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.proxy, func(t *testing.T) {
+			nets, err := parseTrustedProxies([]string{tt.proxy})
+			if tt.want == "" {
+				if err == nil {
+					t.Errorf("parseTrustedProxies(%q) = %v, want an error", tt.proxy, nets)
+				}
+				return
+			}
+			if err != nil || len(nets) != 1 || nets[0].String() != tt.want {
+				t.Errorf("parseTrustedProxies(%q) = %v, %v, want %s", tt.proxy, nets, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	tests := []struct {
+		name     string
+		proxies  []string
+		trusted  bool
+		clientIP string
+	}{
+		{"other proxy", []string{"10.9.9.9"}, false, "127.0.0.1"},
+		{"test client is the proxy", []string{"127.0.0.1"}, true, "203.0.113.7"},
+		{"test client in proxy range", []string{"127.0.0.0/8"}, true, "203.0.113.7"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+			var err error
+			app.config.TrustedProxies = tt.proxies
+			app.proxies, err = parseTrustedProxies(tt.proxies)
+			if err != nil {
+				t.Fatal(err)
+			}
+			srv := serveTestApp(t, app)
+			b := newBrowser(t, srv.URL)
+
+			forwarded := http.Header{
+				"X-Forwarded-Host": {"secure.example.com"},
+				"X-Forwarded-Uri":  {"/"},
+				"X-Forwarded-For":  {"203.0.113.7"},
+			}
+			for _, path := range []string{"/verify", EXT_AUTHZ_PREFIX + "/"} {
+				res, _ := b.do("GET", path, nil, forwarded)
+				if (res.StatusCode == http.StatusForbidden) == tt.trusted {
+					t.Errorf("GET %s: got %d, trusted %v", path, res.StatusCode, tt.trusted)
+				}
+			}
+
+			//envoy's gRPC service checks the address of the connection
+			ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 4000}})
+			cr, err := (&extAuthzServer{app: app}).Check(ctx, &authv3.CheckRequest{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			denied := cr.GetDeniedResponse().GetStatus().GetCode() == http.StatusForbidden && cr.GetStatus().GetCode() == int32(codes.PermissionDenied)
+			if denied == tt.trusted {
+				t.Errorf("grpc check: got %v, trusted %v", cr, tt.trusted)
+			}
+
+			//X-Forwarded-For only counts when a trusted proxy sent it
+			res, _ := b.do("GET", "/", nil, http.Header{"X-Forwarded-For": {"203.0.113.7"}})
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("GET /: got %d", res.StatusCode)
+			}
+			sess, err := app.db.GetSession(b.cookie.Value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sess.IP != tt.clientIP {
+				t.Errorf("client ip = %s, want %s", sess.IP, tt.clientIP)
+			}
+		})
+	}
+}
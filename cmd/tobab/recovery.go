@@ -0,0 +1,274 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gnur/tobab"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+const RECOVERY_LINKS_KEY = "recovery_links"
+const RECOVERY_AGE = 24 * time.Hour
+
+// recoveryLink allows a user that lost their passkeys to enroll a new one on their existing account
+type recoveryLink struct {
+	UserID    []byte
+	CreatedBy string
+	Expires   time.Time
+	RevokeOld bool
+}
+
+type RecoveryStart struct {
+	Token string
+}
+
+func (app *Tobab) setRecoveryRoutes(r *gin.Engine, admin *gin.RouterGroup) {
+	ll := app.logger.With("service", "recovery")
+
+	admin.POST("/recovery", func(c *gin.Context) {
+		sess := app.getSession(c.GetString("SESSION_ID"))
+		adminUser, err := app.db.GetUser(sess.UserID)
+		if err != nil {
+			ll.Error("failed to retrieve user from session", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		u, err := app.db.GetUserByName(c.Query("user"))
+		if err != nil {
+			ll.Warn("invalid username provided", "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		token, err := randomString(32)
+		if err != nil {
+			ll.Error("failed to generate recovery token", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		link := recoveryLink{
+			UserID:    u.ID,
+			CreatedBy: adminUser.Name,
+			Expires:   time.Now().Add(RECOVERY_AGE),
+			RevokeOld: c.PostForm("revoke") != "",
+		}
+		err = app.storeRecoveryLink(tobab.HashSecret(token), link)
+		if err != nil {
+			ll.Error("failed to store recovery link", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		detail := "expires " + link.Expires.Format(time.RFC3339)
+		if link.RevokeOld {
+			detail += ", revokes old passkeys"
+		}
+		app.audit(c, tobab.AuditEvent{
+			Type:   tobab.AUDIT_RECOVERY_LINK,
+			Actor:  adminUser.Name,
+			Target: u.Name,
+			Detail: detail,
+		})
+		c.HTML(200, "recoverylink.html", gin.H{
+			"Link":    app.fqdn + "/register.html?recovery=" + token,
+			"Expires": link.Expires,
+		})
+	})
+
+	r.POST("/passkey/recover/start", func(c *gin.Context) {
+		var start RecoveryStart
+
+		err := c.BindJSON(&start)
+		if err != nil {
+			ll.Warn("failed to parse body", "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		sess := app.getSession(c.GetString("SESSION_ID"))
+
+		if sess.State == "registration" {
+			sess.FSM.Event(c, "finishRegistration")
+			sess.State = sess.FSM.Current()
+		}
+
+		if sess.FSM.Current() != "null" {
+			ll.Warn("invalid source state for this request", "state", sess.FSM.Current())
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		hash := tobab.HashSecret(start.Token)
+		link, err := app.getRecoveryLink(hash)
+		if err != nil {
+			ll.Warn("recovery attempted without a valid link", "error", err)
+			app.audit(c, tobab.AuditEvent{
+				Type:   tobab.AUDIT_RECOVERY_FAILED,
+				Detail: "unknown, used or expired recovery link",
+			})
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"msg": "this recovery link is not valid",
+			})
+			return
+		}
+
+		user, err := app.db.GetUser(link.UserID)
+		if err != nil {
+			ll.Error("failed to retrieve user for recovery link", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		if user.Disabled {
+			ll.Warn("recovery attempted for disabled user", "user", user.Name)
+			app.audit(c, tobab.AuditEvent{
+				Type:   tobab.AUDIT_RECOVERY_FAILED,
+				Target: user.Name,
+				Detail: "account is disabled",
+			})
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"msg": "this account is disabled",
+			})
+			return
+		}
+
+		authSelect := protocol.AuthenticatorSelection{
+			RequireResidentKey: protocol.ResidentKeyRequired(),
+			ResidentKey:        protocol.ResidentKeyRequirementRequired,
+			UserVerification:   protocol.VerificationPreferred,
+		}
+
+		options, session, err := app.webauthn.BeginRegistration(user, webauthn.WithAuthenticatorSelection(authSelect), webauthn.WithConveyancePreference(protocol.PreferNoAttestation))
+		if err != nil {
+			ll.Error("failed to start webauthn registration", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		sess.Data = session
+		sess.UserID = user.ID
+		sess.Vals["recovery"] = hash
+		delete(sess.Vals, "invite")
+
+		err = sess.FSM.Event(c, "startRegistration")
+		if err != nil {
+			ll.Error("failed to transition state", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		err = app.db.SetSession(*sess)
+		if err != nil {
+			ll.Error("failed to save session", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		ll.Info("recovery started", "user", user.Name)
+		app.audit(c, tobab.AuditEvent{
+			Type:   tobab.AUDIT_RECOVERY_START,
+			Actor:  user.Name,
+			Target: user.Name,
+			Detail: "recovery link created by " + link.CreatedBy,
+		})
+		c.AbortWithStatusJSON(http.StatusOK, options)
+	})
+}
+
+// finishRecovery consumes the recovery link of a registration and, when requested, drops the passkeys the user had before
+// and ends every session of the user except the recovering session with ID keep
+func (app *Tobab) finishRecovery(hash string, user *tobab.User, keep string) (*recoveryLink, error) {
+	link, err := app.takeRecoveryLink(hash)
+	if err != nil {
+		return nil, err
+	}
+	if string(link.UserID) != string(user.ID) {
+		return nil, errors.New("recovery link belongs to another user")
+	}
+
+	if link.RevokeOld {
+		user.Creds = nil
+		user.CredInfo = nil
+
+		//whoever had the lost passkeys could still be logged in with them
+		sessions, err := app.db.GetSessionsByUser(user.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range sessions {
+			if s.ID == keep {
+				continue
+			}
+			err = app.db.DeleteSession(s.ID)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return link, nil
+}
+
+// storeRecoveryLink saves link under the hash of its token, replacing older links for the same user
+func (app *Tobab) storeRecoveryLink(hash string, link recoveryLink) error {
+	app.recoveryMu.Lock()
+	defer app.recoveryMu.Unlock()
+
+	links := map[string]recoveryLink{}
+	err := app.db.KVGet(RECOVERY_LINKS_KEY, &links)
+	if err != nil && err != tobab.ErrNotFound {
+		return err
+	}
+
+	for k, v := range links {
+		if v.Expires.Before(time.Now()) || string(v.UserID) == string(link.UserID) {
+			delete(links, k)
+		}
+	}
+	links[hash] = link
+
+	return app.db.KVSet(RECOVERY_LINKS_KEY, links)
+}
+
+// getRecoveryLink returns the link stored under hash as long as it has not expired
+func (app *Tobab) getRecoveryLink(hash string) (*recoveryLink, error) {
+	app.recoveryMu.Lock()
+	defer app.recoveryMu.Unlock()
+
+	links := map[string]recoveryLink{}
+	err := app.db.KVGet(RECOVERY_LINKS_KEY, &links)
+	if err != nil {
+		return nil, err
+	}
+
+	link, ok := links[hash]
+	if !ok || link.Expires.Before(time.Now()) {
+		return nil, tobab.ErrNotFound
+	}
+	return &link, nil
+}
+
+// takeRecoveryLink returns the link stored under hash and removes it so it can only be used once
+func (app *Tobab) takeRecoveryLink(hash string) (*recoveryLink, error) {
+	app.recoveryMu.Lock()
+	defer app.recoveryMu.Unlock()
+
+	links := map[string]recoveryLink{}
+	err := app.db.KVGet(RECOVERY_LINKS_KEY, &links)
+	if err != nil {
+		return nil, err
+	}
+
+	link, ok := links[hash]
+	if !ok || link.Expires.Before(time.Now()) {
+		return nil, tobab.ErrNotFound
+	}
+	delete(links, hash)
+
+	return &link, app.db.KVSet(RECOVERY_LINKS_KEY, links)
+}
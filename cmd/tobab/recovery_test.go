@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gnur/tobab"
+)
+
+func TestFinishRecoveryRevokesSessions(t *testing.T) {
+	app, _ := newTestServer(t)
+
+	bob := tobab.User{ID: []byte("bob"), Name: "bob"}
+	if err := app.db.SetUser(bob); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"stolen", "old-laptop", "recovering"} {
+		s := tobab.Session{ID: id, UserID: bob.ID, Expires: time.Now().Add(time.Hour), Vals: map[string]string{}, FSM: setupFSM("authenticated")}
+		if err := app.db.SetSession(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		revoke bool
+		want   int
+	}{
+		{"keep old passkeys", false, 3},
+		{"revoke old passkeys", true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hash := tobab.HashSecret("recover-" + tt.name)
+			err := app.storeRecoveryLink(hash, recoveryLink{UserID: bob.ID, Expires: time.Now().Add(time.Hour), RevokeOld: tt.revoke})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := app.finishRecovery(hash, &bob, "recovering"); err != nil {
+				t.Fatalf("finishRecovery: %v", err)
+			}
+			sessions, err := app.db.GetSessionsByUser(bob.ID)
+			if err != nil || len(sessions) != tt.want {
+				t.Fatalf("bob has %d sessions after recovery, want %d", len(sessions), tt.want)
+			}
+			if _, err := app.db.GetSession("recovering"); err != nil {
+				t.Errorf("recovering session was ended: %v", err)
+			}
+		})
+	}
+}
+
+func TestRecoveryStartAudit(t *testing.T) {
+	app, srv := newTestServer(t)
+
+	users := []tobab.User{
+		{ID: []byte("bob"), Name: "bob"},
+		{ID: []byte("mallory"), Name: "mallory", Disabled: true},
+	}
+	for _, u := range users {
+		if err := app.db.SetUser(u); err != nil {
+			t.Fatal(err)
+		}
+		err := app.storeRecoveryLink(tobab.HashSecret("recover-"+u.Name), recoveryLink{UserID: u.ID, CreatedBy: "admin", Expires: time.Now().Add(time.Hour)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		token  string
+		status int
+		event  string
+		target string
+	}{
+		{"recover-bob", http.StatusOK, tobab.AUDIT_RECOVERY_START, "bob"},
+		{"recover-unknown", http.StatusForbidden, tobab.AUDIT_RECOVERY_FAILED, ""},
+		{"recover-mallory", http.StatusForbidden, tobab.AUDIT_RECOVERY_FAILED, "mallory"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.token, func(t *testing.T) {
+			b := newBrowser(t, srv.URL)
+			token := b.csrfToken("/register.html?recovery=" + tt.token)
+			res, _ := b.do("POST", "/passkey/recover/start", strings.NewReader(`{"Token": "`+tt.token+`"}`), http.Header{
+				"Content-Type": {"application/json"},
+				CSRF_HEADER:    {token},
+			})
+			if res.StatusCode != tt.status {
+				t.Fatalf("recover start: got %d, want %d", res.StatusCode, tt.status)
+			}
+
+			events, err := app.db.GetAuditEvents(tobab.AuditFilter{Type: tt.event})
+			if err != nil {
+				t.Fatal(err)
+			}
+			found := false
+			for _, e := range events {
+				found = found || e.Target == tt.target
+			}
+			if !found {
+				t.Errorf("no %s audit event for %q in %+v", tt.event, tt.target, events)
+			}
+		})
+	}
+}
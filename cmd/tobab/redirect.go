@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/gnur/tobab"
+)
+
+// validRedirect returns raw when it is safe to send a browser to after login:
+// an absolute http(s) url on tobab itself, under the cookie scope or on a known host
+func (app *Tobab) validRedirect(raw string) (string, bool) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", false
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", false
+	}
+	if u.User != nil || u.Host == "" {
+		return "", false
+	}
+
+	host := strings.ToLower(u.Hostname())
+	switch {
+	case strings.EqualFold(u.Scheme+"://"+u.Host, app.fqdn):
+	case host == strings.ToLower(app.config.Hostname):
+	case app.inCookieScope(host):
+	case tobab.Contains(app.getHosts(), u.Host), tobab.Contains(app.getHosts(), host):
+	default:
+		return "", false
+	}
+	return u.String(), true
+}
+
+// inCookieScope reports whether host, without a port, is the cookie scope or one of its subdomains
+func (app *Tobab) inCookieScope(host string) bool {
+	host = strings.ToLower(host)
+	scope := strings.ToLower(app.config.CookieScope)
+	return scope != "" && (host == scope || strings.HasSuffix(host, "."+scope))
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/gnur/tobab"
+)
+
+func TestValidRedirect(t *testing.T) {
+	app, _ := newTestServer(t)
+	if err := app.db.SetHost(tobab.Host{Name: "app.other.org", Policy: tobab.HOST_POLICY_PRIVATE}); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.db.SetHost(tobab.Host{Name: "pending.other.org", Pending: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		raw  string
+		want bool
+	}{
+		{"https://login.example.com/admin/index.html", true},
+		{"https://secure.example.com/app/?tab=a", true},
+		{"http://example.com/", true},
+		{"https://app.other.org/x", true},
+		{"https://pending.other.org/x", false},
+		{"https://evil.com/", false},
+		{"https://example.com.evil.com/", false},
+		{"https://evilexample.com/", false},
+		{"//evil.com/", false},
+		{"/relative", false},
+		{"javascript:alert(1)", false},
+		{"https://secure.example.com@evil.com/", false},
+		{"https://user@secure.example.com/", false},
+		{"ftp://secure.example.com/", false},
+		{"https://%zz", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			if _, got := app.validRedirect(tt.raw); got != tt.want {
+				t.Errorf("validRedirect(%q) = %v, want %v", tt.raw, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoginRedirectParameter(t *testing.T) {
+	app, srv := newTestServer(t)
+	alice := tobab.User{ID: []byte("alice"), Name: "alice"}
+	if err := app.db.SetUser(alice); err != nil {
+		t.Fatal(err)
+	}
+	b := newBrowser(t, srv.URL)
+	b.login(app, alice)
+
+	tests := []struct {
+		rd       string
+		location string
+	}{
+		{"https://secure.example.com/app/", "https://secure.example.com/app/"},
+		{"https://evil.com/", ""},
+		{"//evil.com/", ""},
+	}
+	for _, tt := range tests {
+		res, _ := b.do("GET", "/?rd="+url.QueryEscape(tt.rd), nil, nil)
+		if got := res.Header.Get("Location"); got != tt.location {
+			t.Errorf("GET /?rd=%s: redirected to %q, want %q", tt.rd, got, tt.location)
+		}
+		if tt.location == "" && res.StatusCode != http.StatusOK {
+			t.Errorf("GET /?rd=%s: got %d, want the login page", tt.rd, res.StatusCode)
+		}
+	}
+}
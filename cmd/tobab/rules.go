@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gnur/tobab"
+	"github.com/lithammer/shortuuid"
+)
+
+var ruleMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+
+func (app *Tobab) setRuleRoutes(admin *gin.RouterGroup) {
+
+	admin.POST("/rules/create", func(c *gin.Context) {
+		host := c.PostForm("host")
+		path := strings.TrimSpace(c.PostForm("path"))
+		policy := c.PostForm("policy")
+		methods := c.PostFormArray("methods")
+		users := c.PostFormArray("users")
+		groups := c.PostFormArray("groups")
+
+		if !tobab.Contains(app.getHosts(), host) {
+			app.logger.Warn("invalid hostname provided", "host", host)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		if !strings.HasPrefix(path, "/") {
+			app.logger.Warn("invalid path provided", "path", path)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		if policy != tobab.POLICY_PUBLIC && policy != tobab.POLICY_AUTHENTICATED && policy != tobab.POLICY_USERS {
+			app.logger.Warn("invalid policy provided", "policy", policy)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		for _, m := range methods {
+			if !tobab.Contains(ruleMethods, m) {
+				app.logger.Warn("invalid method provided", "method", m)
+				c.AbortWithStatus(http.StatusBadRequest)
+				return
+			}
+		}
+
+		for _, u := range users {
+			if _, err := app.db.GetUserByName(u); err != nil {
+				app.logger.Warn("invalid username provided", "error", err)
+				c.AbortWithStatus(http.StatusBadRequest)
+				return
+			}
+		}
+
+		for _, g := range groups {
+			if _, err := app.db.GetGroup(g); err != nil {
+				app.logger.Warn("invalid group provided", "error", err)
+				c.AbortWithStatus(http.StatusBadRequest)
+				return
+			}
+		}
+
+		priority, err := strconv.Atoi(c.DefaultPostForm("priority", "0"))
+		if err != nil {
+			app.logger.Warn("invalid priority provided", "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		err = app.db.SetAccessRule(tobab.AccessRule{
+			ID:       shortuuid.New(),
+			Host:     host,
+			Path:     tobab.Glob(path),
+			Methods:  methods,
+			Policy:   policy,
+			Users:    users,
+			Groups:   groups,
+			Priority: priority,
+			Created:  time.Now(),
+		})
+		if err != nil {
+			app.logger.Error("failed to save access rule", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		c.Redirect(http.StatusSeeOther, "/admin/index.html")
+	})
+
+	admin.POST("/rules/delete", func(c *gin.Context) {
+		err := app.db.DeleteAccessRule(c.Query("id"))
+		if err == tobab.ErrNotFound {
+			app.logger.Warn("invalid rule provided", "id", c.Query("id"))
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			app.logger.Error("failed to delete access rule", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		c.Header("HX-Refresh", "true")
+		c.JSON(200, gin.H{})
+	})
+}
+
+// requestPath returns the decoded path of a forwarded uri without its query and fragment
+func requestPath(uri string) (string, bool) {
+	if uri == "" {
+		return "/", true
+	}
+	u, err := url.ParseRequestURI(uri)
+	if err != nil {
+		return "", false
+	}
+	return u.Path, true
+}
+
+// getAccessRules returns all access rules, ordered in the way they are evaluated
+func (app *Tobab) getAccessRules() []tobab.AccessRule {
+	rules, err := app.db.GetAccessRules()
+	if err != nil {
+		app.logger.Error("Failed to get access rules", "error", err)
+	}
+
+	sort.SliceStable(rules, func(i, j int) bool {
+		if rules[i].Priority != rules[j].Priority {
+			return rules[i].Priority < rules[j].Priority
+		}
+		return rules[i].Created.Before(rules[j].Created)
+	})
+	return rules
+}
+
+// matchAccessRule returns the rule that applies to a forwarded request, uri may include a query string.
+// A uri that can't be parsed matches no rule, decide rejects those requests before they get here.
+func (app *Tobab) matchAccessRule(host, uri, method string) *tobab.AccessRule {
+	path, ok := requestPath(uri)
+	if !ok {
+		return nil
+	}
+	if method == "" {
+		method = http.MethodGet
+	}
+	return tobab.MatchAccessRule(app.getAccessRules(), host, path, method)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gnur/tobab"
+)
+
+func TestAccessRulesVerify(t *testing.T) {
+	app, srv := newTestServer(t)
+	b := newBrowser(t, srv.URL)
+
+	if err := app.db.SetHost(tobab.Host{Name: "secure.example.com", Policy: tobab.HOST_POLICY_PRIVATE}); err != nil {
+		t.Fatal(err)
+	}
+	rules := []tobab.AccessRule{
+		{ID: "health", Host: "secure.example.com", Path: "/public/health", Policy: tobab.POLICY_USERS, Priority: 1},
+		{ID: "public", Host: "secure.example.com", Path: "/public/*", Methods: []string{"GET"}, Policy: tobab.POLICY_PUBLIC, Priority: 2},
+	}
+	for _, r := range rules {
+		r.Created = time.Now()
+		if err := app.db.SetAccessRule(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		uri    string
+		method string
+		want   int
+	}{
+		{"public rule", "/public/app.css?v=1", "GET", http.StatusOK},
+		{"method not covered by public rule", "/public/app.css", "POST", http.StatusTemporaryRedirect},
+		{"higher priority rule wins", "/public/health", "GET", http.StatusTemporaryRedirect},
+		{"private host without rule", "/admin/x", "GET", http.StatusTemporaryRedirect},
+		{"traversal out of public rule", "/public/../admin/x", "GET", http.StatusTemporaryRedirect},
+		{"encoded traversal out of public rule", "/public/%2e%2e/admin/x", "GET", http.StatusTemporaryRedirect},
+		{"traversal in query of invalid uri", "/admin/%zz?/../../public/x", "GET", http.StatusBadRequest},
+		{"traversal in fragment", "/admin/x#/../../public/y", "GET", http.StatusTemporaryRedirect},
+		{"traversal in fragment of invalid uri", "/admin/%zz#/../../public/y", "GET", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, _ := b.do("GET", "/verify", nil, http.Header{
+				"X-Forwarded-Host":   {"secure.example.com"},
+				"X-Forwarded-Proto":  {"https"},
+				"X-Forwarded-Uri":    {tt.uri},
+				"X-Forwarded-Method": {tt.method},
+			})
+			if res.StatusCode != tt.want {
+				t.Errorf("verify %s %s: got %d, want %d", tt.method, tt.uri, res.StatusCode, tt.want)
+			}
+		})
+	}
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"strings"
 	"time"
 
+	"github.com/gin-gonic/gin"
 	"github.com/gnur/tobab"
 	"github.com/lithammer/shortuuid"
 	"github.com/looplab/fsm"
@@ -25,10 +27,6 @@ func setupFSM(base string) *fsm.FSM {
 
 			//from authenticated
 			{Name: "logout", Src: []string{"authenticated"}, Dst: "null"},
-			{Name: "addRegistration", Src: []string{"authenticated"}, Dst: "authRegistration"},
-
-			//from authRegistration
-			{Name: "finsihAuthRegistration", Src: []string{"authRegistration"}, Dst: "authenticated"},
 		},
 		fsm.Callbacks{},
 	)
@@ -65,12 +63,22 @@ func (app *Tobab) getSession(id string) *tobab.Session {
 			State:   "null",
 		}
 	}
+	//adding a passkey used to move the session to authRegistration, those users are still logged in
+	if s.State == "authRegistration" {
+		s.State = "authenticated"
+	}
 	s.LastSeen = time.Now()
 	s.Expires = time.Now().Add(app.defaultAge)
 	s.FSM = setupFSM(s.State)
 	if s.Vals == nil {
 		s.Vals = make(map[string]string)
 	}
+	if s.Vals["csrf"] == "" {
+		err := renewCSRFToken(s)
+		if err != nil {
+			app.logger.Error("failed to create csrf token", "error", err)
+		}
+	}
 
 	err := app.db.SetSession(*s)
 	if err != nil {
@@ -80,3 +88,82 @@ func (app *Tobab) getSession(id string) *tobab.Session {
 
 	return s
 }
+
+// rotateSession moves sess to a new ID and points the cookie at it, so an ID that
+// was known before a privilege change is worthless after it
+func (app *Tobab) rotateSession(c *gin.Context, sess *tobab.Session) error {
+	oldID := sess.ID
+	sess.ID = shortuuid.New()
+
+	err := app.db.RotateSession(oldID, *sess)
+	if err != nil {
+		sess.ID = oldID
+		return err
+	}
+
+	app.setSessionCookie(c, sess.ID)
+	c.Set("SESSION_ID", sess.ID)
+	return nil
+}
+
+// setSessionCookie sets the session cookie, replacing one that was already set in this response
+func (app *Tobab) setSessionCookie(c *gin.Context, id string) {
+	h := c.Writer.Header()
+	cookies := h.Values("Set-Cookie")
+	h.Del("Set-Cookie")
+	for _, raw := range cookies {
+		if strings.HasPrefix(raw, COOKIE_NAME+"=") {
+			continue
+		}
+		h.Add("Set-Cookie", raw)
+	}
+	c.SetCookie(COOKIE_NAME, id, int(app.defaultAge.Seconds()), "/", app.config.CookieScope, true, true)
+}
+
+// ROTATE_KEY marks a session that gets a new ID on its next request to tobab
+const ROTATE_KEY = "rotate"
+
+// rotateUserSessions is called when u gained privileges, a session ID of u that leaked before must not
+// carry them for long. The session of the request gets a new ID and cookie right away, the other sessions
+// of u are marked and get theirs on their next request, so u stays logged in everywhere.
+func (app *Tobab) rotateUserSessions(c *gin.Context, u *tobab.User) {
+	sessions, err := app.db.GetSessionsByUser(u.ID)
+	if err != nil {
+		app.logger.Error("failed to retrieve sessions", "error", err, "user", u.Name)
+		return
+	}
+
+	current := c.GetString("SESSION_ID")
+	for _, s := range sessions {
+		if !sessionActive(s) {
+			continue
+		}
+		s.FSM = setupFSM(s.State)
+		if s.ID == current {
+			err = app.rotateSession(c, &s)
+		} else {
+			if s.Vals == nil {
+				s.Vals = make(map[string]string)
+			}
+			s.Vals[ROTATE_KEY] = "true"
+			err = app.db.SetSession(s)
+		}
+		if err != nil {
+			app.logger.Error("failed to rotate session", "error", err, "user", u.Name)
+		}
+	}
+}
+
+// rotateGroupSessions rotates the sessions of every member of g after the group gained access
+func (app *Tobab) rotateGroupSessions(c *gin.Context, g *tobab.Group) {
+	users, err := app.db.GetUsers()
+	if err != nil {
+		app.logger.Error("failed to retrieve users from database", "error", err)
+		return
+	}
+	for _, u := range users {
+		if u.MemberOf(*g) {
+			app.rotateUserSessions(c, &u)
+		}
+	}
+}
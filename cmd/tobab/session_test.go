@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gnur/tobab"
+)
+
+func TestPrivilegeChangeRotatesSessions(t *testing.T) {
+	app, srv := newTestServer(t)
+
+	if err := app.db.SetHost(tobab.Host{Name: "secure.example.com", Policy: tobab.HOST_POLICY_PRIVATE}); err != nil {
+		t.Fatal(err)
+	}
+	admin := tobab.User{ID: []byte("admin"), Name: "admin", Admin: true}
+	bob := tobab.User{ID: []byte("bob"), Name: "bob"}
+	for _, u := range []tobab.User{admin, bob} {
+		if err := app.db.SetUser(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	g := tobab.Group{ID: "ops", Name: "ops"}
+	if err := app.db.SetGroup(g); err != nil {
+		t.Fatal(err)
+	}
+
+	a := newBrowser(t, srv.URL)
+	adminSess := a.login(app, admin)
+	post := func(path string, form url.Values) {
+		t.Helper()
+		res, _ := a.do("POST", path, strings.NewReader(form.Encode()), http.Header{
+			CSRF_HEADER:    {adminSess.Vals["csrf"]},
+			"Content-Type": {"application/x-www-form-urlencoded"},
+		})
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("POST %s: got %d, want 200", path, res.StatusCode)
+		}
+	}
+
+	//every step changes the privileges of bob, only the raises rotate his sessions
+	tests := []struct {
+		name   string
+		path   string
+		form   url.Values
+		rotate bool
+	}{
+		{"grant admin", "/admin/toggleAdmin?user=bob", nil, true},
+		{"revoke admin", "/admin/toggleAdmin?user=bob", nil, false},
+		{"grant access", "/admin/toggleAccess?user=bob&host=secure.example.com", nil, true},
+		{"revoke access", "/admin/toggleAccess?user=bob&host=secure.example.com", nil, false},
+		{"temporary grant", "/admin/grant?user=bob", url.Values{"host": {"secure.example.com"}}, true},
+		{"join group", "/admin/groups/toggleMember?group=ops&user=bob", nil, true},
+		{"group access", "/admin/groups/toggleAccess?group=ops&host=secure.example.com", nil, true},
+		{"group access revoked", "/admin/groups/toggleAccess?group=ops&host=secure.example.com", nil, false},
+		{"leave group", "/admin/groups/toggleMember?group=ops&user=bob", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bb := newBrowser(t, srv.URL)
+			old := bb.login(app, bob)
+
+			post(tt.path, tt.form)
+
+			//bob is never logged out, his next request to tobab moves him to a new session ID when his privileges were raised
+			res, _ := bb.do("GET", "/", nil, nil)
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("next request of bob: got %d, want 200", res.StatusCode)
+			}
+			if rotated := bb.cookie.Value != old.ID; rotated != tt.rotate {
+				t.Errorf("session of bob rotated: %v, want %v", rotated, tt.rotate)
+			}
+			if _, err := app.db.GetSession(old.ID); (err == tobab.ErrNotFound) != tt.rotate {
+				t.Errorf("old session ID of bob after the change: %v", err)
+			}
+			sess, err := app.db.GetSession(bb.cookie.Value)
+			if err != nil || sess.State != "authenticated" || string(sess.UserID) != "bob" {
+				t.Errorf("session of bob: got %+v, %v, want bob logged in", sess, err)
+			}
+		})
+	}
+
+	//the admin granting themselves access gets a new session ID in the response
+	oldID := a.cookie.Value
+	post("/admin/grant?user=admin", url.Values{"host": {"secure.example.com"}})
+	if a.cookie.Value == oldID {
+		t.Fatalf("session of the admin was not rotated")
+	}
+	if _, err := app.db.GetSession(oldID); err != tobab.ErrNotFound {
+		t.Errorf("old session ID of the admin still works: %v", err)
+	}
+	sess, err := app.db.GetSession(a.cookie.Value)
+	if err != nil || sess.State != "authenticated" || string(sess.UserID) != "admin" {
+		t.Errorf("rotated session of the admin: got %+v, %v, want authenticated admin", sess, err)
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gnur/tobab"
+)
+
+// activeSession is a logged in session as shown on the sessions page.
+// Ref identifies the session without exposing its ID, which is the cookie value.
+type activeSession struct {
+	Ref       string
+	Device    string
+	IP        string
+	Created   time.Time
+	LastSeen  time.Time
+	Expires   time.Time
+	Current   bool
+	UserAgent string
+}
+
+type sessionVars struct {
+	State string
+	User  *tobab.User
+	CSRF  string
+
+	Owner    *tobab.User
+	Admin    bool
+	Sessions []activeSession
+}
+
+func (app *Tobab) setSessionRoutes(r *gin.Engine, admin *gin.RouterGroup) {
+	sesslog := app.logger.With("method", "sessions")
+
+	sessions := r.Group("/sessions")
+	sessions.Use(app.authenticatedMiddleware())
+
+	sessions.GET("/index.html", func(c *gin.Context) {
+		sess := app.getSession(c.GetString("SESSION_ID"))
+		user, err := app.db.GetUser(sess.UserID)
+		if err != nil {
+			sesslog.Error("failed to retrieve user from session", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		active, err := app.activeSessions(user, sess.ID)
+		if err != nil {
+			sesslog.Error("failed to retrieve sessions", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		c.HTML(200, "sessions.html", sessionVars{
+			CSRF:     c.GetString("CSRF_TOKEN"),
+			State:    sess.State,
+			User:     user,
+			Owner:    user,
+			Sessions: active,
+		})
+	})
+
+	sessions.POST("/revoke", func(c *gin.Context) {
+		sess := app.getSession(c.GetString("SESSION_ID"))
+		user, err := app.db.GetUser(sess.UserID)
+		if err != nil {
+			sesslog.Error("failed to retrieve user from session", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		app.revokeSessions(c, user, user.Name, sess.ID, c.Query("ref"))
+	})
+
+	sessions.POST("/revokeOthers", func(c *gin.Context) {
+		sess := app.getSession(c.GetString("SESSION_ID"))
+		user, err := app.db.GetUser(sess.UserID)
+		if err != nil {
+			sesslog.Error("failed to retrieve user from session", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		app.revokeSessions(c, user, user.Name, sess.ID, "")
+	})
+
+	admin.GET("/sessions.html", func(c *gin.Context) {
+		sess := app.getSession(c.GetString("SESSION_ID"))
+		viewer, err := app.db.GetUser(sess.UserID)
+		if err != nil {
+			sesslog.Error("failed to retrieve user from session", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		owner, err := app.db.GetUserByName(c.Query("user"))
+		if err != nil {
+			sesslog.Warn("invalid username provided", "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		active, err := app.activeSessions(owner, sess.ID)
+		if err != nil {
+			sesslog.Error("failed to retrieve sessions", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		c.HTML(200, "sessions.html", sessionVars{
+			CSRF:     c.GetString("CSRF_TOKEN"),
+			State:    sess.State,
+			User:     viewer,
+			Owner:    owner,
+			Admin:    true,
+			Sessions: active,
+		})
+	})
+
+	admin.POST("/sessions/revoke", func(c *gin.Context) {
+		owner, err := app.db.GetUserByName(c.Query("user"))
+		if err != nil {
+			sesslog.Warn("invalid username provided", "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		app.revokeSessions(c, owner, app.sessionUserName(c), c.GetString("SESSION_ID"), c.Query("ref"))
+	})
+
+	admin.POST("/sessions/revokeOthers", func(c *gin.Context) {
+		owner, err := app.db.GetUserByName(c.Query("user"))
+		if err != nil {
+			sesslog.Warn("invalid username provided", "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		app.revokeSessions(c, owner, app.sessionUserName(c), c.GetString("SESSION_ID"), "")
+	})
+}
+
+// sessionRef is the reference to a session used in urls and on the sessions page
+func sessionRef(id string) string {
+	return tobab.HashSecret(id)[:16]
+}
+
+// activeSessions returns the logged in, unexpired sessions of a user, most recently used first
+func (app *Tobab) activeSessions(user *tobab.User, currentID string) ([]activeSession, error) {
+	all, err := app.db.GetSessionsByUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	var active []activeSession
+	for _, s := range all {
+		if !sessionActive(s) {
+			continue
+		}
+		active = append(active, activeSession{
+			Ref:       sessionRef(s.ID),
+			Device:    deviceName(s.UserAgent),
+			IP:        s.IP,
+			Created:   s.Created,
+			LastSeen:  s.LastSeen,
+			Expires:   s.Expires,
+			Current:   s.ID == currentID,
+			UserAgent: s.UserAgent,
+		})
+	}
+	sort.SliceStable(active, func(i, j int) bool {
+		return active[i].LastSeen.After(active[j].LastSeen)
+	})
+	return active, nil
+}
+
+func sessionActive(s tobab.Session) bool {
+	return (s.State == "authenticated" || s.State == "authRegistration") && s.Expires.After(time.Now())
+}
+
+// revokeSessions removes the session of user identified by ref, or every active session
+// except currentID when ref is empty
+func (app *Tobab) revokeSessions(c *gin.Context, user *tobab.User, actor, currentID, ref string) {
+	all, err := app.db.GetSessionsByUser(user.ID)
+	if err != nil {
+		app.logger.Error("failed to retrieve sessions", "error", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	found := false
+	for _, s := range all {
+		if !sessionActive(s) {
+			continue
+		}
+		if ref == "" && s.ID == currentID {
+			continue
+		}
+		if ref != "" && sessionRef(s.ID) != ref {
+			continue
+		}
+		found = true
+
+		err = app.db.DeleteSession(s.ID)
+		if err != nil {
+			app.logger.Error("failed to delete session", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		app.audit(c, tobab.AuditEvent{
+			Type:   tobab.AUDIT_SESSION_REVOKED,
+			Actor:  actor,
+			Target: user.Name,
+			Detail: strings.TrimSpace(deviceName(s.UserAgent) + " " + s.IP),
+		})
+	}
+
+	if ref != "" && !found {
+		app.logger.Warn("invalid session provided", "user", user.Name, "ref", ref)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	c.Header("HX-Refresh", "true")
+	c.JSON(200, gin.H{})
+}
+
+var browsers = []struct{ token, name string }{
+	{"Edg/", "Edge"},
+	{"OPR/", "Opera"},
+	{"Firefox/", "Firefox"},
+	{"Chrome/", "Chrome"},
+	{"Safari/", "Safari"},
+	{"curl/", "curl"},
+}
+
+var platforms = []struct{ token, name string }{
+	{"iPhone", "iOS"},
+	{"iPad", "iPadOS"},
+	{"Android", "Android"},
+	{"Windows", "Windows"},
+	{"Mac OS X", "macOS"},
+	{"CrOS", "ChromeOS"},
+	{"Linux", "Linux"},
+}
+
+// deviceName turns a user agent into a short description like "Firefox on Linux"
+func deviceName(ua string) string {
+	if ua == "" {
+		return "unknown device"
+	}
+	browser, platform := "", ""
+	for _, b := range browsers {
+		if strings.Contains(ua, b.token) {
+			browser = b.name
+			break
+		}
+	}
+	for _, p := range platforms {
+		if strings.Contains(ua, p.token) {
+			platform = p.name
+			break
+		}
+	}
+	switch {
+	case browser != "" && platform != "":
+		return browser + " on " + platform
+	case browser != "":
+		return browser
+	case platform != "":
+		return platform
+	}
+	if len(ua) > 40 {
+		return ua[:37] + "..."
+	}
+	return ua
+}
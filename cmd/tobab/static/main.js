@@ -1,11 +1,37 @@
 let abortController;
 let abortSignal;
 
+// every state changing request needs the csrf token of the session
+function csrfToken() {
+  let meta = document.querySelector('meta[name="csrf-token"]');
+  return meta ? meta.content : "";
+}
+
+document.addEventListener("htmx:configRequest", (event) => {
+  event.detail.headers["X-CSRF-Token"] = csrfToken();
+});
+
 function onload() {
+  let search = document.querySelector("#launcher-search");
+  if (search) {
+    search.addEventListener("input", () => {
+      filterLauncher(search.value);
+    }, false);
+  }
   if (!window.PublicKeyCredential || !PublicKeyCredential.isConditionalMediationAvailable) {
     console.log("no window.PublicKeyCredential");
     return;
   }
+  let addBtn = document.querySelector("#addpasskey");
+  if (addBtn) {
+    addBtn.addEventListener("click", (a, event) => {
+      a.preventDefault();
+      addBtn.disabled = true;
+      addPasskey().finally(() => {
+        addBtn.disabled = false;
+      });
+    }, false);
+  }
   Promise.all([
     PublicKeyCredential.isConditionalMediationAvailable(),
     PublicKeyCredential.isUserVerifyingPlatformAuthenticatorAvailable()
@@ -32,6 +58,14 @@ function onload() {
   })
 };
 
+function filterLauncher(query) {
+  let words = query.toLowerCase().split(/\s+/).filter(w => w !== "");
+  document.querySelectorAll("#launcher .tile").forEach(tile => {
+    let text = tile.dataset.search.toLowerCase();
+    tile.style.display = words.every(w => text.includes(w)) ? "" : "none";
+  });
+}
+
 function showError(msg) {
   let errDiv = document.querySelector("#error-div");
   let dialog = document.querySelector("#messages");
@@ -47,14 +81,28 @@ function startRegister() {
     showError("Invalid username");
     return
   }
-  fetch("/passkey/register/start",
+  let invite = document.querySelector("#invite");
+  let recovery = document.querySelector("#recovery");
+  let url = "/passkey/register/start";
+  let body = { "Name": username, "Invite": invite ? invite.value : "" };
+  if (recovery) {
+    url = "/passkey/recover/start";
+    body = { "Token": recovery.value };
+  }
+  fetch(url,
     {
       method: "POST",
       headers: {
         "Content-Type": "application/json",
+        "X-CSRF-Token": csrfToken(),
       },
-      body: JSON.stringify({ "Name": username }),
+      body: JSON.stringify(body),
     }).then(res => {
+      if (!res.ok) {
+        return res.json().then(body => {
+          throw new Error(body.msg);
+        })
+      }
       return res.json()
     }).then(credentialCreationOptions => {
       credentialCreationOptions.publicKey.challenge = base64url.decode(credentialCreationOptions.publicKey.challenge);
@@ -78,6 +126,7 @@ function startRegister() {
           method: "POST",
           headers: {
             "Content-Type": "application/json",
+            "X-CSRF-Token": csrfToken(),
           },
           body: JSON.stringify({
             id: credential.id,
@@ -89,7 +138,12 @@ function startRegister() {
             },
           }),
         })
-        .then(_ => {
+        .then(res => {
+          if (!res.ok) {
+            return res.json().then(body => {
+              throw new Error(body.msg);
+            })
+          }
           showError("successfully registered " + username + "!")
           document.location = "/";
           return
@@ -103,6 +157,54 @@ function startRegister() {
     })
 }
 
+let addPasskey = async () => {
+  try {
+    let res = await fetch("/passkey/add/start", { method: "POST", headers: { "X-CSRF-Token": csrfToken() } });
+    if (!res.ok) {
+      throw new Error("failed to start passkey registration");
+    }
+    let credentialCreationOptions = await res.json();
+    credentialCreationOptions.publicKey.challenge = base64url.decode(credentialCreationOptions.publicKey.challenge);
+    credentialCreationOptions.publicKey.user.id = base64url.decode(credentialCreationOptions.publicKey.user.id);
+    if (credentialCreationOptions.publicKey.excludeCredentials) {
+      for (var i = 0; i < credentialCreationOptions.publicKey.excludeCredentials.length; i++) {
+        credentialCreationOptions.publicKey.excludeCredentials[i].id = base64url.decode(credentialCreationOptions.publicKey.excludeCredentials[i].id);
+      }
+    }
+
+    let credential;
+    try {
+      credential = await navigator.credentials.create({
+        publicKey: credentialCreationOptions.publicKey,
+      });
+    } catch (error) {
+      await fetch("/passkey/add/finish?cancel=true", { method: "POST", headers: { "X-CSRF-Token": csrfToken() } });
+      throw error;
+    }
+
+    res = await fetch("/passkey/add/finish", {
+      method: "POST",
+      headers: { "Content-Type": "application/json", "X-CSRF-Token": csrfToken() },
+      body: JSON.stringify({
+        id: credential.id,
+        rawId: base64url.encode(credential.rawId),
+        type: credential.type,
+        response: {
+          attestationObject: base64url.encode(credential.response.attestationObject),
+          clientDataJSON: base64url.encode(credential.response.clientDataJSON),
+        },
+      }),
+    });
+    if (!res.ok) {
+      let body = await res.json();
+      throw new Error(body.msg);
+    }
+    document.location.reload();
+  } catch (error) {
+    showError("failed to add passkey<br>" + error);
+  }
+}
+
 let startDiscoverableLogin = async () => {
 
   console.log("disc-in: start");
@@ -134,6 +236,7 @@ let startDiscoverableLogin = async () => {
   let credentialRequestOptions = await fetch("/passkey/login/anystart",
     {
       method: "POST",
+      headers: { "X-CSRF-Token": csrfToken() },
     }).then(res => {
       console.log("disc-in: got json");
       return res.json()
@@ -157,7 +260,7 @@ let startDiscoverableLogin = async () => {
 
   fetch("/passkey/login/finish", {
     method: "POST",
-    headers: { "Content-Type": "application/json", },
+    headers: { "Content-Type": "application/json", "X-CSRF-Token": csrfToken() },
     body: JSON.stringify({
       id: assertion.id,
       rawId: base64url.encode(rawId),
@@ -60,6 +60,7 @@ var templateFunctions = template.FuncMap{
 		seconds := int64(diff.Seconds())
 		if seconds < 0 {
 			tense = "from now"
+			seconds = -seconds
 		}
 		var quantifier string
 
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
 	"io/fs"
 	"net/http"
-	"net/url"
+	"strconv"
 	"time"
 
-	"github.com/asdine/storm"
 	"github.com/gin-gonic/gin"
 	"github.com/gnur/tobab"
 	"github.com/go-webauthn/webauthn/protocol"
@@ -18,7 +20,8 @@ import (
 const ADMIN_REGISTERED_KEY = "admin_registered"
 
 type RegistrationStart struct {
-	Name string
+	Name   string
+	Invite string
 }
 
 func (app *Tobab) setTobabRoutes(r *gin.Engine) {
@@ -50,6 +53,20 @@ func (app *Tobab) setTobabRoutes(r *gin.Engine) {
 			return
 		}
 
+		delete(sess.Vals, "invite")
+		delete(sess.Vals, "recovery")
+		if app.inviteRequired() {
+			invite, err := app.validInvite(regStart.Invite)
+			if err != nil {
+				pklog.Warn("registration without a valid invite", "username", regStart.Name, "error", err)
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+					"msg": "a valid invite is required to register",
+				})
+				return
+			}
+			sess.Vals["invite"] = invite.Hash
+		}
+
 		u, err := app.db.GetUserByName(regStart.Name)
 		if err == nil {
 			pklog.Warn("user that already exists in db is trying to register", "username", u.Name)
@@ -152,13 +169,74 @@ func (app *Tobab) setTobabRoutes(r *gin.Engine) {
 			return
 		}
 
+		event := tobab.AuditEvent{
+			Type:   tobab.AUDIT_REGISTRATION,
+			Actor:  user.Name,
+			Target: user.Name,
+		}
+
+		if hash, ok := sess.Vals["recovery"]; ok {
+			link, err := app.finishRecovery(hash, user, sess.ID)
+			if err != nil {
+				pklog.Warn("recovery link was used or expired during recovery", "username", user.Name, "error", err)
+				app.audit(c, tobab.AuditEvent{
+					Type:   tobab.AUDIT_RECOVERY_FAILED,
+					Actor:  user.Name,
+					Target: user.Name,
+					Detail: "recovery link was used or expired before the passkey was enrolled",
+				})
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+					"msg": "recovery link is no longer valid",
+				})
+				return
+			}
+			delete(sess.Vals, "recovery")
+			event.Type = tobab.AUDIT_RECOVERY
+			event.Detail = "recovery link created by " + link.CreatedBy
+			if link.RevokeOld {
+				event.Detail += ", old passkeys and sessions revoked"
+			}
+		} else if hash, ok := sess.Vals["invite"]; ok {
+			//deleting the invite is what makes it single use, only one registration can succeed
+			invite, err := app.db.GetInviteByHash(hash)
+			if err == nil && invite.Expired() {
+				err = errors.New("invite expired")
+			}
+			if err == nil {
+				err = app.db.DeleteInvite(invite.ID)
+			}
+			if err != nil {
+				pklog.Warn("invite was used, revoked or expired during registration", "username", user.Name, "error", err)
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+					"msg": "invite is no longer valid",
+				})
+				return
+			}
+			delete(sess.Vals, "invite")
+
+			for _, h := range invite.Hosts {
+				if !user.CanAccess(h) {
+					user.GrantAccess(tobab.Grant{Host: h})
+				}
+			}
+			user.Groups = append(user.Groups, invite.Groups...)
+			event.Detail = "invite " + invite.ID + " created by " + invite.CreatedBy
+		} else if app.inviteRequired() {
+			pklog.Warn("registration without a valid invite", "username", user.Name)
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"msg": "a valid invite is required to register",
+			})
+			return
+		}
+
 		hasAdmin, err := app.db.KVGetBool(ADMIN_REGISTERED_KEY)
 		if err == nil && !hasAdmin {
 			user.Admin = true
 			app.db.KVSet(ADMIN_REGISTERED_KEY, true)
+			event.Detail = "first user, registered as admin"
 		}
 
-		user.Creds = append(user.Creds, *credential)
+		user.AddCredential(*credential, authenticatorName(credential.Authenticator.AAGUID))
 		user.RegistrationFinished = true
 		err = app.db.SetUser(*user)
 		if err != nil {
@@ -166,6 +244,7 @@ func (app *Tobab) setTobabRoutes(r *gin.Engine) {
 			c.AbortWithStatus(http.StatusInternalServerError)
 			return
 		}
+		app.audit(c, event)
 
 		err = sess.FSM.Event(c, "finishRegistration")
 		if err != nil {
@@ -174,9 +253,12 @@ func (app *Tobab) setTobabRoutes(r *gin.Engine) {
 			return
 		}
 
-		err = app.db.SetSession(*sess)
+		err = renewCSRFToken(sess)
+		if err == nil {
+			err = app.rotateSession(c, sess)
+		}
 		if err != nil {
-			pklog.Error("failed to save session", "error", err)
+			pklog.Error("failed to rotate session", "error", err)
 			c.AbortWithStatus(http.StatusInternalServerError)
 			return
 		}
@@ -251,6 +333,10 @@ func (app *Tobab) setTobabRoutes(r *gin.Engine) {
 		user, err := app.db.GetUser(resp.Response.UserHandle)
 		if err != nil {
 			pklog.Error("failed to retrieve user from session", "error", err)
+			app.audit(c, tobab.AuditEvent{
+				Type:   tobab.AUDIT_LOGIN_FAILED,
+				Detail: "unknown user",
+			})
 			c.AbortWithStatus(http.StatusInternalServerError)
 			return
 		}
@@ -260,10 +346,36 @@ func (app *Tobab) setTobabRoutes(r *gin.Engine) {
 		credential, err := app.webauthn.ValidateLogin(user, *webSess, resp)
 		if err != nil {
 			pklog.Error("failed to validate login", "error", err)
+			app.audit(c, tobab.AuditEvent{
+				Type:   tobab.AUDIT_LOGIN_FAILED,
+				Actor:  user.Name,
+				Detail: err.Error(),
+			})
 			c.AbortWithStatus(403)
 			return
 		}
 
+		if user.Disabled {
+			pklog.Warn("disabled user tried to log in", "user", user.Name)
+			app.audit(c, tobab.AuditEvent{
+				Type:   tobab.AUDIT_LOGIN_FAILED,
+				Actor:  user.Name,
+				Detail: "user disabled",
+			})
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"msg": "this account is disabled",
+			})
+			return
+		}
+
+		user.CredentialUsed(*credential)
+		err = app.db.SetUser(*user)
+		if err != nil {
+			pklog.Error("failed to store credential with user", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
 		err = sess.FSM.Event(c, "loginSuccess")
 		if err != nil {
 			pklog.Error("failed to transition state", "error", err)
@@ -272,21 +384,36 @@ func (app *Tobab) setTobabRoutes(r *gin.Engine) {
 		}
 
 		sess.UserID = user.WebAuthnID()
+		sess.Vals["auth_time"] = strconv.FormatInt(time.Now().Unix(), 10)
 
-		err = app.db.SetSession(*sess)
+		//a new ID and csrf token after login, so ones planted before it can't ride along
+		err = renewCSRFToken(sess)
+		if err == nil {
+			err = app.rotateSession(c, sess)
+		}
 		if err != nil {
-			pklog.Error("failed to save session", "error", err)
+			pklog.Error("failed to rotate session", "error", err)
 			c.AbortWithStatus(http.StatusInternalServerError)
 			return
 		}
 
-		pklog.Debug("success logging in!", "cred", credential.ID)
+		app.audit(c, tobab.AuditEvent{
+			Type:   tobab.AUDIT_LOGIN,
+			Actor:  user.Name,
+			Detail: "passkey " + user.CredInfo[tobab.CredentialID(*credential)].Name,
+		})
 
 		res := gin.H{}
 
-		if url, ok := sess.Vals["redirect_url"]; ok {
+		if raw, ok := sess.Vals["redirect_url"]; ok {
 			delete(sess.Vals, "redirect_url")
 			app.db.SetSession(*sess)
+
+			url, ok := app.validRedirect(raw)
+			if !ok {
+				pklog.Warn("refusing to redirect to invalid url", "redirect_url", raw)
+				url = app.fqdn
+			}
 			pklog.Info("redirecting to url")
 			res = gin.H{
 				"redirect_url": url,
@@ -337,32 +464,71 @@ func (app *Tobab) setTobabRoutes(r *gin.Engine) {
 			name = user.Name
 		}
 
-		c.HTML(200, "register.html", tplVars{
-			State:    sess.State,
-			Username: name,
-		})
+		invite := c.Query("invite")
+		if invite != "" {
+			if _, err := app.validInvite(invite); err != nil {
+				pklog.Warn("invalid invite on registration page", "error", err)
+				invite = ""
+			}
+		}
+
+		vars := registerVars{
+			State:          sess.State,
+			CSRF:           c.GetString("CSRF_TOKEN"),
+			Username:       name,
+			Invite:         invite,
+			InviteRequired: app.inviteRequired(),
+		}
+
+		if recovery := c.Query("recovery"); recovery != "" {
+			var u *tobab.User
+			link, err := app.getRecoveryLink(tobab.HashSecret(recovery))
+			if err == nil {
+				u, err = app.db.GetUser(link.UserID)
+			}
+			if err != nil {
+				pklog.Warn("invalid recovery link on registration page", "error", err)
+			} else {
+				vars.Recovery = recovery
+				vars.Username = u.Name
+			}
+		}
+
+		c.HTML(200, "register.html", vars)
 	})
 
 	r.GET("/verify", app.verifyForwardAuth)
 
-	r.GET("/register", func(c *gin.Context) {
+	app.setAPIKeyRoutes(r)
+	app.setPasskeyRoutes(r)
+	app.setJWKSRoutes(r)
+
+	//both end the current session, so they are posted with the csrf token instead of being plain links
+	r.POST("/register", func(c *gin.Context) {
 
 		sess := app.getSession(c.GetString("SESSION_ID"))
 		sess.Expires = time.Now().Add(-2 * app.maxAge)
 		app.db.SetSession(*sess)
 
 		c.SetCookie(COOKIE_NAME, "", -1, "/", app.config.CookieScope, true, true)
-		c.Redirect(307, "/register.html")
+		c.Redirect(http.StatusSeeOther, "/register.html")
 	})
 
-	r.GET("/signout", func(c *gin.Context) {
+	r.POST("/signout", func(c *gin.Context) {
+
+		if name := app.sessionUserName(c); name != "" {
+			app.audit(c, tobab.AuditEvent{
+				Type:  tobab.AUDIT_LOGOUT,
+				Actor: name,
+			})
+		}
 
 		sess := app.getSession(c.GetString("SESSION_ID"))
 		sess.Expires = time.Now().Add(-2 * app.maxAge)
 		app.db.SetSession(*sess)
 
 		c.SetCookie(COOKIE_NAME, "", -1, "/", app.config.CookieScope, true, true)
-		c.Redirect(307, "/")
+		c.Redirect(http.StatusSeeOther, "/")
 	})
 
 	admin := r.Group("/admin")
@@ -386,17 +552,11 @@ func (app *Tobab) setTobabRoutes(r *gin.Engine) {
 			return
 		}
 
-		found := false
-
-		for i, h := range u.AccessibleHosts {
-			if h == hostName {
-				u.AccessibleHosts = append(u.AccessibleHosts[:i], u.AccessibleHosts[i+1:]...)
-				found = true
-				break
-			}
-		}
-		if !found {
-			u.AccessibleHosts = append(u.AccessibleHosts, hostName)
+		granted := !u.CanAccess(hostName)
+		if granted {
+			u.GrantAccess(tobab.Grant{Host: hostName})
+		} else {
+			u.RevokeAccess(hostName)
 		}
 		err = app.db.SetUser(*u)
 		if err != nil {
@@ -404,10 +564,36 @@ func (app *Tobab) setTobabRoutes(r *gin.Engine) {
 			c.AbortWithStatus(http.StatusInternalServerError)
 			return
 		}
+		if granted {
+			app.rotateUserSessions(c, u)
+		}
+
+		app.audit(c, tobab.AuditEvent{
+			Type:   tobab.AUDIT_TOGGLE_ACCESS,
+			Actor:  app.sessionUserName(c),
+			Target: u.Name,
+			Host:   hostName,
+			Detail: grantDetail(granted),
+		})
 
 		c.JSON(200, gin.H{})
 	})
 
+	app.setRuleRoutes(admin)
+	app.setGroupRoutes(admin)
+	app.setOIDCRoutes(r, admin)
+	app.setInviteRoutes(admin)
+	app.setRecoveryRoutes(r, admin)
+	app.setAuditRoutes(admin)
+	app.setAccessRequestRoutes(r, admin)
+	app.setGrantRoutes(admin)
+	app.setHostRoutes(admin)
+	app.setLauncherRoutes(r)
+	app.setSessionRoutes(r, admin)
+	app.setNginxRoutes(r)
+	app.setExtAuthzRoutes(r)
+	app.setUserRoutes(admin)
+
 	admin.POST("/toggleAdmin", func(c *gin.Context) {
 		userName := c.Query("user")
 
@@ -426,6 +612,16 @@ func (app *Tobab) setTobabRoutes(r *gin.Engine) {
 			c.AbortWithStatus(http.StatusInternalServerError)
 			return
 		}
+		if u.Admin {
+			app.rotateUserSessions(c, u)
+		}
+
+		app.audit(c, tobab.AuditEvent{
+			Type:   tobab.AUDIT_TOGGLE_ADMIN,
+			Actor:  app.sessionUserName(c),
+			Target: u.Name,
+			Detail: grantDetail(u.Admin),
+		})
 
 		c.JSON(200, gin.H{})
 	})
@@ -450,9 +646,14 @@ func (app *Tobab) setTobabRoutes(r *gin.Engine) {
 		}
 
 		c.HTML(200, "admin.html", adminVars{
-			Users: users,
-			Hosts: hosts,
-			User:  *user,
+			CSRF:     c.GetString("CSRF_TOKEN"),
+			Users:    users,
+			Hosts:    hosts,
+			Groups:   app.getGroups(),
+			Rules:    app.getAccessRules(),
+			Methods:  ruleMethods,
+			Requests: app.pendingAccessRequests(),
+			User:     *user,
 		})
 	})
 
@@ -471,15 +672,41 @@ func (app *Tobab) setTobabRoutes(r *gin.Engine) {
 			}
 
 		}
+		if rd := c.Query("rd"); rd != "" {
+			target, ok := app.validRedirect(rd)
+			if !ok {
+				pklog.Warn("ignoring invalid redirect url", "rd", rd)
+			} else if user != nil {
+				c.Redirect(http.StatusFound, target)
+				return
+			} else {
+				sess.Vals["redirect_url"] = target
+				err = app.db.SetSession(*sess)
+				if err != nil {
+					pklog.Error("failed to save session", "error", err)
+				}
+			}
+		}
+
 		name := "unknown"
+		var requests []tobab.AccessRequest
+		var apps []launcherApp
 		if user != nil {
 			name = user.Name
+			apps = app.launcherApps(user)
+			requests = app.userAccessRequests(user)
+			if len(requests) > ACCESS_REQUESTS_SHOWN {
+				requests = requests[:ACCESS_REQUESTS_SHOWN]
+			}
 		}
 
 		c.HTML(200, "index.html", tplVars{
+			CSRF:     c.GetString("CSRF_TOKEN"),
 			State:    sess.State,
 			User:     user,
 			Username: name,
+			Requests: requests,
+			Apps:     apps,
 		})
 	})
 
@@ -489,16 +716,45 @@ func (app *Tobab) setTobabRoutes(r *gin.Engine) {
 type adminVars struct {
 	State string
 	User  tobab.User
-
-	Users []tobab.User
-	Hosts []string
+	CSRF  string
+
+	Users    []tobab.User
+	Hosts    []string
+	Groups   []tobab.Group
+	Rules    []tobab.AccessRule
+	Methods  []string
+	Requests []tobab.AccessRequest
 }
 
 type tplVars struct {
 	State string
 	User  *tobab.User
+	CSRF  string
 
 	Username string
+	Requests []tobab.AccessRequest
+	Apps     []launcherApp
+}
+
+type registerVars struct {
+	State string
+	User  *tobab.User
+	CSRF  string
+
+	Username       string
+	Invite         string
+	InviteRequired bool
+	Recovery       string
+}
+
+// randomString returns n random bytes encoded as url safe base64
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
 }
 
 func (app *Tobab) mustFS() http.FileSystem {
@@ -508,78 +764,3 @@ func (app *Tobab) mustFS() http.FileSystem {
 	sub, _ := fs.Sub(staticFS, "static")
 	return http.FS(sub)
 }
-
-func (app *Tobab) verifyForwardAuth(c *gin.Context) {
-	var user *tobab.User
-	var err error
-
-	ll := app.logger.With("service", "verify")
-	sess := app.getSession(c.GetString("SESSION_ID"))
-
-	host := c.GetHeader("X-Forwarded-Host")
-	proto := c.GetHeader("X-Forwarded-Proto")
-	uri := c.GetHeader("X-Forwarded-Uri")
-	u := "unknown"
-
-	ll = ll.With(
-		"host", host,
-		"proto", proto,
-		"uri", uri,
-		"user", u,
-	)
-
-	app.addHost(host)
-
-	if sess.State != "authenticated" {
-		redirect_url, err := url.ParseRequestURI(uri)
-		if err != nil {
-			redirect_url = &url.URL{}
-		}
-		redirect_url.Host = host
-		redirect_url.Scheme = proto
-
-		sess.Vals["redirect_url"] = redirect_url.String()
-		err = app.db.SetSession(*sess)
-		if err != nil {
-			ll.Error("failed to save session", "error", err)
-		}
-		ll.With("redirect_url", redirect_url.String()).Info("redirecting to login")
-
-		c.Header("HX-Redirect", app.fqdn)
-		c.Redirect(http.StatusTemporaryRedirect, app.fqdn)
-		return
-	}
-
-	user, err = app.db.GetUser(sess.UserID)
-	if err != nil && err != storm.ErrNotFound {
-		ll.Error("failed to retrieve user from session", "error", err)
-		c.AbortWithStatus(http.StatusInternalServerError)
-		return
-	}
-
-	if user == nil {
-		c.Header("HX-Redirect", app.fqdn)
-		c.Redirect(http.StatusTemporaryRedirect, app.fqdn)
-		return
-	}
-
-	ll = ll.With(
-		"user", user.Name,
-	)
-
-	if user.Admin {
-		ll.Info("Return 200 to admin")
-		c.AbortWithStatus(200)
-		return
-	}
-
-	if user.CanAccess(host) {
-		ll.Info("Return 200 to user")
-		c.AbortWithStatus(200)
-		return
-	}
-
-	ll.Warn("Return 307 to unknown user")
-	c.Header("HX-Redirect", app.fqdn)
-	c.Redirect(http.StatusTemporaryRedirect, app.fqdn)
-}
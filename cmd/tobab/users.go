@@ -0,0 +1,176 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gnur/tobab"
+)
+
+func (app *Tobab) setUserRoutes(admin *gin.RouterGroup) {
+	ulog := app.logger.With("method", "users")
+
+	admin.POST("/toggleDisabled", func(c *gin.Context) {
+		u, ok := app.lifecycleTarget(c)
+		if !ok {
+			return
+		}
+
+		u.Disabled = !u.Disabled
+
+		err := app.db.SetUser(*u)
+		if err != nil {
+			ulog.Error("failed to update user", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		detail := "enabled"
+		if u.Disabled {
+			detail = "disabled"
+		}
+		app.audit(c, tobab.AuditEvent{
+			Type:   tobab.AUDIT_USER_DISABLED,
+			Actor:  app.sessionUserName(c),
+			Target: u.Name,
+			Detail: detail,
+		})
+
+		//a disabled user should not keep the sessions they already have
+		if u.Disabled {
+			app.forceLogout(c, u)
+		}
+
+		c.Header("HX-Refresh", "true")
+		c.JSON(200, gin.H{})
+	})
+
+	admin.POST("/forceLogout", func(c *gin.Context) {
+		u, err := app.db.GetUserByName(c.Query("user"))
+		if err != nil {
+			ulog.Warn("invalid username provided", "error", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		if !app.forceLogout(c, u) {
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		c.Header("HX-Refresh", "true")
+		c.JSON(200, gin.H{})
+	})
+
+	admin.POST("/deleteUser", func(c *gin.Context) {
+		u, ok := app.lifecycleTarget(c)
+		if !ok {
+			return
+		}
+		actor := app.sessionUserName(c)
+
+		if !app.forceLogout(c, u) {
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		keys, err := app.db.GetAPIKeys(u.ID)
+		if err != nil {
+			ulog.Error("failed to retrieve api keys", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		for _, k := range keys {
+			err = app.db.DeleteAPIKey(k.ID)
+			if err != nil {
+				ulog.Error("failed to delete api key", "error", err)
+				c.AbortWithStatus(http.StatusInternalServerError)
+				return
+			}
+		}
+
+		err = app.db.DeleteUser(u.ID)
+		if err != nil {
+			ulog.Error("failed to delete user", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		//rules refer to users by name, a new user with the same name should not inherit them
+		for _, r := range app.getAccessRules() {
+			if !tobab.Contains(r.Users, u.Name) {
+				continue
+			}
+			r.Users = remove(r.Users, u.Name)
+			err = app.db.SetAccessRule(r)
+			if err != nil {
+				ulog.Warn("failed to update access rule", "error", err)
+			}
+		}
+
+		requests, err := app.db.GetAccessRequestsByUser(u.ID)
+		if err != nil {
+			ulog.Warn("failed to retrieve access requests", "error", err)
+		}
+		for _, req := range requests {
+			if !req.Pending() {
+				continue
+			}
+			req.Status = tobab.ACCESS_REQUEST_DENIED
+			req.DecidedBy = actor
+			req.Decided = time.Now()
+			err = app.db.SetAccessRequest(req)
+			if err != nil {
+				ulog.Warn("failed to store access request", "error", err)
+			}
+		}
+
+		app.audit(c, tobab.AuditEvent{
+			Type:   tobab.AUDIT_USER_DELETED,
+			Actor:  actor,
+			Target: u.Name,
+			Detail: strconv.Itoa(len(u.Creds)) + " passkeys, " + strconv.Itoa(len(keys)) + " api keys",
+		})
+
+		c.Header("HX-Refresh", "true")
+		c.JSON(200, gin.H{})
+	})
+}
+
+// lifecycleTarget returns the user an admin wants to disable or delete, admins can't do that to themselves
+func (app *Tobab) lifecycleTarget(c *gin.Context) (*tobab.User, bool) {
+	u, err := app.db.GetUserByName(c.Query("user"))
+	if err != nil {
+		app.logger.Warn("invalid username provided", "error", err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return nil, false
+	}
+
+	if u.Name == app.sessionUserName(c) {
+		app.logger.Warn("admin tried to disable or delete themselves", "user", u.Name)
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"msg": "you can not disable or delete yourself",
+		})
+		return nil, false
+	}
+	return u, true
+}
+
+// forceLogout ends every session of u
+func (app *Tobab) forceLogout(c *gin.Context, u *tobab.User) bool {
+	n, err := app.db.DeleteSessionsByUser(u.ID)
+	if err != nil {
+		app.logger.Error("failed to delete sessions", "error", err, "user", u.Name)
+		return false
+	}
+
+	app.audit(c, tobab.AuditEvent{
+		Type:   tobab.AUDIT_FORCE_LOGOUT,
+		Actor:  app.sessionUserName(c),
+		Target: u.Name,
+		Detail: strconv.Itoa(n) + " sessions",
+	})
+	return true
+}
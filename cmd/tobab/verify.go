@@ -0,0 +1,321 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gnur/tobab"
+)
+
+// results of a forward auth decision, also used as metric label
+const (
+	VERIFY_ALLOW    = "allow"
+	VERIFY_REDIRECT = "redirect" //not logged in
+	VERIFY_DENY     = "deny"
+	VERIFY_ERROR    = "error"
+)
+
+// verifyRequest is what a proxy asks tobab about a request, whichever protocol it used to ask
+type verifyRequest struct {
+	Host   string
+	Proto  string
+	URI    string
+	Method string
+	IP     string
+
+	SessionID string
+	APIKey    string
+}
+
+// verifyDecision is the answer to a verifyRequest, the front-ends turn it into their own response format
+type verifyDecision struct {
+	Result string
+	Status int
+
+	//User is set when the request came from a known user, also when it is denied
+	User *tobab.User
+	//Headers are the identity headers for the upstream of an allowed request
+	Headers http.Header
+	//AskAccess is set when a logged in user is denied and can request access to the host
+	AskAccess bool
+}
+
+// OriginalURL is the url the user tried to open
+func (r verifyRequest) OriginalURL() string {
+	u, err := url.ParseRequestURI(r.URI)
+	if err != nil {
+		u = &url.URL{}
+	}
+	u.Host = r.Host
+	u.Scheme = r.Proto
+	return u.String()
+}
+
+// decide runs the access checks of a forward auth request
+func (app *Tobab) decide(req verifyRequest) verifyDecision {
+	ll := app.logger.With(
+		"service", "verify",
+		"host", req.Host,
+		"proto", req.Proto,
+		"uri", req.URI,
+		"method", req.Method,
+		"ip", req.IP,
+	)
+
+	//the front-ends only get here for requests of trusted proxies
+	app.discoverHost(req.Host)
+
+	//the rules can't be matched against a uri that doesn't parse, the part after a ? or # would be taken for the path
+	if _, ok := requestPath(req.URI); !ok {
+		ll.Warn("Return 400 for invalid uri")
+		return verifyDecision{Result: VERIFY_DENY, Status: http.StatusBadRequest}
+	}
+
+	rule := app.matchAccessRule(req.Host, req.URI, req.Method)
+	if rule != nil {
+		ll = ll.With("rule", rule.ID)
+		if rule.Allows(nil) {
+			ll.Info("Return 200 for public rule")
+			return verifyDecision{Result: VERIFY_ALLOW, Status: http.StatusOK}
+		}
+	} else if app.hostPolicy(req.Host) == tobab.HOST_POLICY_PUBLIC {
+		ll.Info("Return 200 for public host")
+		return verifyDecision{Result: VERIFY_ALLOW, Status: http.StatusOK}
+	}
+
+	if req.APIKey != "" {
+		return app.decideAPIKey(req, ll, rule)
+	}
+
+	sess := app.activeSession(req.SessionID)
+	if sess == nil || sess.State != "authenticated" {
+		ll.Info("user is not logged in")
+		return verifyDecision{Result: VERIFY_REDIRECT, Status: http.StatusUnauthorized}
+	}
+
+	user, err := app.db.GetUser(sess.UserID)
+	if err == tobab.ErrNotFound {
+		ll.Info("user of session is gone")
+		return verifyDecision{Result: VERIFY_REDIRECT, Status: http.StatusUnauthorized}
+	}
+	if err != nil {
+		ll.Error("failed to retrieve user from session", "error", err)
+		return verifyDecision{Result: VERIFY_ERROR, Status: http.StatusInternalServerError}
+	}
+
+	ll = ll.With("user", user.Name)
+
+	if user.Disabled {
+		ll.Warn("Return 403 to disabled user")
+		app.audit(nil, tobab.AuditEvent{
+			Type:   tobab.AUDIT_VERIFY_DENIED,
+			Actor:  user.Name,
+			Host:   req.Host,
+			IP:     req.IP,
+			Detail: "user disabled",
+		})
+		return verifyDecision{Result: VERIFY_DENY, Status: http.StatusForbidden, User: user}
+	}
+
+	allowed := user.Admin
+	if !allowed && rule != nil {
+		allowed = rule.Allows(user)
+	} else if !allowed {
+		allowed = app.canAccess(user, req.Host)
+	}
+
+	if allowed {
+		ll.Info("Return 200 to user", "admin", user.Admin)
+		app.recordVisit(user, req.Host)
+		return verifyDecision{
+			Result:  VERIFY_ALLOW,
+			Status:  http.StatusOK,
+			User:    user,
+			Headers: app.identityHeaders(user, req.Host),
+		}
+	}
+
+	ll.Warn("Return access denied to user")
+	app.audit(nil, tobab.AuditEvent{
+		Type:   tobab.AUDIT_VERIFY_DENIED,
+		Actor:  user.Name,
+		Host:   req.Host,
+		IP:     req.IP,
+		Detail: req.Method + " " + req.URI,
+	})
+	return verifyDecision{Result: VERIFY_DENY, Status: http.StatusForbidden, User: user, AskAccess: true}
+}
+
+// decideAPIKey answers a forward auth request that carries an API key instead of a session cookie
+func (app *Tobab) decideAPIKey(req verifyRequest, ll *slog.Logger, rule *tobab.AccessRule) verifyDecision {
+	ll = ll.With("auth", "apikey")
+
+	k, err := app.db.GetAPIKeyByHash(tobab.HashSecret(req.APIKey))
+	if err != nil {
+		if err != tobab.ErrNotFound {
+			ll.Error("failed to retrieve api key", "error", err)
+		}
+		ll.Warn("Return 401 for unknown api key")
+		app.audit(nil, tobab.AuditEvent{
+			Type:   tobab.AUDIT_VERIFY_DENIED,
+			Host:   req.Host,
+			IP:     req.IP,
+			Detail: "unknown api key",
+		})
+		return verifyDecision{Result: VERIFY_DENY, Status: http.StatusUnauthorized}
+	}
+
+	if k.Expired() {
+		ll.Warn("Return 401 for expired api key", "key", k.ID)
+		app.audit(nil, tobab.AuditEvent{
+			Type:   tobab.AUDIT_VERIFY_DENIED,
+			Host:   req.Host,
+			IP:     req.IP,
+			Detail: "expired api key " + k.Name,
+		})
+		return verifyDecision{Result: VERIFY_DENY, Status: http.StatusUnauthorized}
+	}
+
+	user, err := app.db.GetUser(k.UserID)
+	if err != nil {
+		ll.Error("failed to retrieve user for api key", "error", err, "key", k.ID)
+		return verifyDecision{Result: VERIFY_DENY, Status: http.StatusUnauthorized}
+	}
+
+	ll = ll.With("user", user.Name, "key", k.ID)
+
+	if user.Disabled {
+		ll.Warn("Return 401 for api key of disabled user")
+		app.audit(nil, tobab.AuditEvent{
+			Type:   tobab.AUDIT_VERIFY_DENIED,
+			Actor:  user.Name,
+			Host:   req.Host,
+			IP:     req.IP,
+			Detail: "api key " + k.Name + " of disabled user",
+		})
+		return verifyDecision{Result: VERIFY_DENY, Status: http.StatusUnauthorized, User: user}
+	}
+
+	allowed := app.canAccess(user, req.Host)
+	if rule != nil {
+		allowed = rule.Allows(user)
+	}
+
+	if !k.CanAccess(req.Host) || !allowed {
+		ll.Warn("Return 403 to api key")
+		app.audit(nil, tobab.AuditEvent{
+			Type:   tobab.AUDIT_VERIFY_DENIED,
+			Actor:  user.Name,
+			Host:   req.Host,
+			IP:     req.IP,
+			Detail: "api key " + k.Name,
+		})
+		return verifyDecision{Result: VERIFY_DENY, Status: http.StatusForbidden, User: user}
+	}
+
+	if time.Since(k.LastUsed) > time.Minute {
+		k.LastUsed = time.Now()
+		err = app.db.SetAPIKey(*k)
+		if err != nil {
+			ll.Error("failed to update api key", "error", err)
+		}
+	}
+
+	ll.Info("Return 200 to api key")
+	return verifyDecision{
+		Result:  VERIFY_ALLOW,
+		Status:  http.StatusOK,
+		User:    user,
+		Headers: app.identityHeaders(user, req.Host),
+	}
+}
+
+// activeSession loads a session that has not expired, without creating a new one.
+// Proxies that don't pass through getSessionMiddleware keep the session alive here.
+func (app *Tobab) activeSession(id string) *tobab.Session {
+	if id == "" {
+		return nil
+	}
+	sess, err := app.db.GetSession(id)
+	if err != nil || sess.Expires.Before(time.Now()) {
+		return nil
+	}
+	//same as getSession, adding a passkey used to move the session to authRegistration
+	if sess.State == "authRegistration" {
+		sess.State = "authenticated"
+	}
+	if time.Since(sess.LastSeen) > time.Minute {
+		sess.LastSeen = time.Now()
+		sess.Expires = time.Now().Add(app.defaultAge)
+		sess.FSM = setupFSM(sess.State)
+		err = app.db.SetSession(*sess)
+		if err != nil {
+			app.logger.Error("failed to save session", "error", err)
+		}
+	}
+	return sess
+}
+
+// verifyForwardAuth is the forward auth endpoint for caddy, traefik and nginx
+func (app *Tobab) verifyForwardAuth(c *gin.Context) {
+	ll := app.logger.With("service", "verify")
+
+	//forwarded headers can be set by anyone, only proxies in front of tobab are allowed to decide them
+	if !app.fromTrustedProxy(c) {
+		ll.Warn("Return 403 to untrusted source", "remote", c.RemoteIP())
+		c.Set("VERIFY_RESULT", VERIFY_DENY)
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+
+	req := verifyRequest{IP: c.ClientIP(), SessionID: c.GetString("SESSION_ID")}
+	req.Host, req.Proto, req.URI, req.Method = forwardedRequest(c)
+	req.APIKey, _ = apiKeyFromRequest(c)
+	c.Set("VERIFY_HOST", req.Host)
+
+	d := app.decide(req)
+	c.Set("VERIFY_RESULT", d.Result)
+
+	switch {
+	case d.Result == VERIFY_ALLOW:
+		for k := range d.Headers {
+			c.Header(k, d.Headers.Get(k))
+		}
+		c.AbortWithStatus(http.StatusOK)
+
+	case d.Result == VERIFY_REDIRECT:
+		//remember where the user wanted to go for after the login
+		sess := app.getSession(req.SessionID)
+		raw := req.OriginalURL()
+		if rd := c.Query("rd"); rd != "" {
+			raw = rd
+		}
+		if target, ok := app.validRedirect(raw); ok {
+			sess.Vals["redirect_url"] = target
+		} else {
+			ll.Warn("not storing invalid redirect url", "redirect_url", raw)
+			delete(sess.Vals, "redirect_url")
+		}
+		err := app.db.SetSession(*sess)
+		if err != nil {
+			ll.Error("failed to save session", "error", err)
+		}
+
+		if nginxMode(c) {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		ll.With("redirect_url", raw).Info("redirecting to login")
+		c.Header("HX-Redirect", app.fqdn)
+		c.Redirect(http.StatusTemporaryRedirect, app.fqdn)
+
+	case d.AskAccess:
+		app.denyForwardAuth(c, d.User, req.Host)
+
+	default:
+		c.AbortWithStatus(d.Status)
+	}
+}
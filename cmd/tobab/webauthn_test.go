@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+)
+
+// softAuthenticator creates passkeys with "none" attestation, like a browser with a platform authenticator would
+type softAuthenticator struct {
+	t      *testing.T
+	origin string
+}
+
+// create answers the credential creation options tobab sent in options and returns the body for register/finish
+func (a softAuthenticator) create(options string) string {
+	a.t.Helper()
+	var opts struct {
+		PublicKey struct {
+			Challenge string `json:"challenge"`
+			RP        struct {
+				ID string `json:"id"`
+			} `json:"rp"`
+		} `json:"publicKey"`
+	}
+	if err := json.Unmarshal([]byte(options), &opts); err != nil || opts.PublicKey.Challenge == "" {
+		a.t.Fatalf("invalid credential creation options %q: %v", options, err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	coseKey, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{
+			KeyType:   int64(webauthncose.EllipticKey),
+			Algorithm: int64(webauthncose.AlgES256),
+		},
+		Curve:  int64(webauthncose.P256),
+		XCoord: key.X.FillBytes(make([]byte, 32)),
+		YCoord: key.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	credID := make([]byte, 16)
+	rand.Read(credID)
+
+	//rp id hash, flags user present, verified and attested credential data, sign count, aaguid, credential id and key
+	rpHash := sha256.Sum256([]byte(opts.PublicKey.RP.ID))
+	authData := append(rpHash[:], 0x45, 0, 0, 0, 0)
+	authData = append(authData, make([]byte, 16)...)
+	authData = binary.BigEndian.AppendUint16(authData, uint16(len(credID)))
+	authData = append(authData, credID...)
+	authData = append(authData, coseKey...)
+
+	attestation, err := webauthncbor.Marshal(struct {
+		Fmt      string         `cbor:"fmt"`
+		AttStmt  map[string]any `cbor:"attStmt"`
+		AuthData []byte         `cbor:"authData"`
+	}{"none", map[string]any{}, authData})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	clientData, _ := json.Marshal(map[string]string{
+		"type":      "webauthn.create",
+		"challenge": opts.PublicKey.Challenge,
+		"origin":    a.origin,
+	})
+
+	b64 := base64.RawURLEncoding.EncodeToString
+	body, _ := json.Marshal(map[string]any{
+		"id":    b64(credID),
+		"rawId": b64(credID),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    b64(clientData),
+			"attestationObject": b64(attestation),
+		},
+	})
+	return string(body)
+}
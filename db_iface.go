@@ -1,5 +1,10 @@
 package tobab
 
+import "errors"
+
+// ErrNotFound is returned by Database implementations when a record does not exist
+var ErrNotFound = errors.New("not found")
+
 type Database interface {
 	KVSet(string, any) error
 
@@ -11,8 +16,53 @@ type Database interface {
 	GetUser([]byte) (*User, error)
 	GetUserByName(string) (*User, error)
 	SetUser(User) error
+	DeleteUser([]byte) error
 
 	GetSession(string) (*Session, error)
-	CleanupOldSessions()
+	GetSessionsByUser([]byte) ([]Session, error)
+	DeleteSession(string) error
+	DeleteSessionsByUser([]byte) (int, error)
+	CleanupOldSessions() (int, error)
+	CountActiveSessions() (int, error)
 	SetSession(Session) error
+	RotateSession(string, Session) error
+
+	GetAPIKeys([]byte) ([]APIKey, error)
+	GetAPIKeyByHash(string) (*APIKey, error)
+	SetAPIKey(APIKey) error
+	DeleteAPIKey(string) error
+
+	GetAccessRules() ([]AccessRule, error)
+	SetAccessRule(AccessRule) error
+	DeleteAccessRule(string) error
+
+	GetGroups() ([]Group, error)
+	GetGroup(string) (*Group, error)
+	SetGroup(Group) error
+	DeleteGroup(string) error
+
+	GetOIDCClients() ([]OIDCClient, error)
+	GetOIDCClient(string) (*OIDCClient, error)
+	SetOIDCClient(OIDCClient) error
+	DeleteOIDCClient(string) error
+
+	GetInvites() ([]Invite, error)
+	GetInviteByHash(string) (*Invite, error)
+	SetInvite(Invite) error
+	DeleteInvite(string) error
+
+	GetHosts() ([]Host, error)
+	GetHost(string) (*Host, error)
+	SetHost(Host) error
+	DeleteHost(string) error
+
+	GetAccessRequests() ([]AccessRequest, error)
+	GetAccessRequestsByUser([]byte) ([]AccessRequest, error)
+	GetAccessRequest(string) (*AccessRequest, error)
+	SetAccessRequest(AccessRequest) error
+
+	AddAuditEvent(AuditEvent) error
+	GetAuditEvents(AuditFilter) ([]AuditEvent, error)
+
+	Close()
 }
@@ -0,0 +1,900 @@
+// Package dbtest contains a conformance suite for implementations of tobab.Database
+//
+// A backend plugs into it from its own tests by passing a constructor:
+//
+//	func TestConformance(t *testing.T) {
+//		dbtest.Run(t, func(t *testing.T) tobab.Database {
+//			db, err := New(filepath.Join(t.TempDir(), "tobab.db"))
+//			if err != nil {
+//				t.Fatal(err)
+//			}
+//			return db
+//		})
+//	}
+package dbtest
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gnur/tobab"
+	"github.com/looplab/fsm"
+)
+
+// Constructor returns a new and empty database, it is called once for every test
+type Constructor func(t *testing.T) tobab.Database
+
+// Run executes all conformance tests against databases created by newDB
+func Run(t *testing.T, newDB Constructor) {
+	tests := []struct {
+		name string
+		test func(*testing.T, tobab.Database)
+	}{
+		{"KVString", testKVString},
+		{"KVBool", testKVBool},
+		{"KVSlice", testKVSlice},
+		{"KVNotFound", testKVNotFound},
+		{"UserCRUD", testUserCRUD},
+		{"UserNameUnique", testUserNameUnique},
+		{"UserNotFound", testUserNotFound},
+		{"Session", testSession},
+		{"SessionNotFound", testSessionNotFound},
+		{"SessionsByUser", testSessionsByUser},
+		{"RotateSession", testRotateSession},
+		{"CleanupOldSessions", testCleanupOldSessions},
+		{"APIKeys", testAPIKeys},
+		{"AccessRules", testAccessRules},
+		{"Groups", testGroups},
+		{"OIDCClients", testOIDCClients},
+		{"Invites", testInvites},
+		{"Hosts", testHosts},
+		{"AccessRequests", testAccessRequests},
+		{"AuditEvents", testAuditEvents},
+		{"ConcurrentWriters", testConcurrentWriters},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			db := newDB(t)
+			t.Cleanup(db.Close)
+			tc.test(t, db)
+		})
+	}
+}
+
+func newSession(id string, state string, expires time.Time) tobab.Session {
+	return tobab.Session{
+		ID:       id,
+		Created:  time.Now(),
+		LastSeen: time.Now(),
+		Expires:  expires,
+		Vals:     map[string]string{},
+		FSM:      fsm.NewFSM(state, fsm.Events{}, fsm.Callbacks{}),
+		State:    state,
+	}
+}
+
+func testKVString(t *testing.T, db tobab.Database) {
+	if err := db.KVSet("string", "first"); err != nil {
+		t.Fatalf("KVSet: %v", err)
+	}
+	if err := db.KVSet("string", "second"); err != nil {
+		t.Fatalf("KVSet overwrite: %v", err)
+	}
+
+	s, err := db.KVGetString("string")
+	if err != nil {
+		t.Fatalf("KVGetString: %v", err)
+	}
+	if s != "second" {
+		t.Errorf("KVGetString = %q, want %q", s, "second")
+	}
+
+	var v string
+	if err := db.KVGet("string", &v); err != nil {
+		t.Fatalf("KVGet: %v", err)
+	}
+	if v != "second" {
+		t.Errorf("KVGet = %q, want %q", v, "second")
+	}
+}
+
+func testKVBool(t *testing.T, db tobab.Database) {
+	for _, want := range []bool{true, false} {
+		if err := db.KVSet("bool", want); err != nil {
+			t.Fatalf("KVSet: %v", err)
+		}
+		b, err := db.KVGetBool("bool")
+		if err != nil {
+			t.Fatalf("KVGetBool: %v", err)
+		}
+		if b != want {
+			t.Errorf("KVGetBool = %v, want %v", b, want)
+		}
+	}
+}
+
+func testKVSlice(t *testing.T, db tobab.Database) {
+	want := []string{"a.example.com", "b.example.com"}
+	if err := db.KVSet("slice", want); err != nil {
+		t.Fatalf("KVSet: %v", err)
+	}
+
+	var got []string
+	if err := db.KVGet("slice", &got); err != nil {
+		t.Fatalf("KVGet: %v", err)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("KVGet = %v, want %v", got, want)
+	}
+}
+
+func testKVNotFound(t *testing.T, db tobab.Database) {
+	if _, err := db.KVGetString("missing"); !errors.Is(err, tobab.ErrNotFound) {
+		t.Errorf("KVGetString on missing key: got %v, want ErrNotFound", err)
+	}
+	if _, err := db.KVGetBool("missing"); !errors.Is(err, tobab.ErrNotFound) {
+		t.Errorf("KVGetBool on missing key: got %v, want ErrNotFound", err)
+	}
+	var v []string
+	if err := db.KVGet("missing", &v); !errors.Is(err, tobab.ErrNotFound) {
+		t.Errorf("KVGet on missing key: got %v, want ErrNotFound", err)
+	}
+}
+
+func testUserCRUD(t *testing.T, db tobab.Database) {
+	u := tobab.User{
+		ID:              []byte("user-1"),
+		Name:            "alice",
+		Created:         time.Now(),
+		AccessibleHosts: []string{"a.example.com"},
+	}
+	if err := db.SetUser(u); err != nil {
+		t.Fatalf("SetUser: %v", err)
+	}
+
+	got, err := db.GetUser(u.ID)
+	if err != nil {
+		t.Fatalf("GetUser: %v", err)
+	}
+	if got.Name != "alice" || !got.CanAccess("a.example.com") {
+		t.Errorf("GetUser returned %+v", got)
+	}
+	got.GrantAccess(tobab.Grant{Host: "b.example.com", NotAfter: time.Now().Add(time.Hour)})
+	got.GrantAccess(tobab.Grant{Host: "c.example.com", NotAfter: time.Now().Add(-time.Hour)})
+	got.GrantAccess(tobab.Grant{Host: "d.example.com", NotBefore: time.Now().Add(time.Hour)})
+	if err := db.SetUser(*got); err != nil {
+		t.Fatalf("SetUser with grants: %v", err)
+	}
+	got, err = db.GetUser(u.ID)
+	if err != nil {
+		t.Fatalf("GetUser with grants: %v", err)
+	}
+	if !got.CanAccess("b.example.com") || got.CanAccess("c.example.com") || got.CanAccess("d.example.com") {
+		t.Errorf("GetUser returned grants %+v", got.Grants)
+	}
+	if expired := got.PruneGrants(); len(expired) != 1 || expired[0].Host != "c.example.com" || len(got.Grants) != 2 {
+		t.Errorf("PruneGrants returned %+v and kept %+v", expired, got.Grants)
+	}
+	got.RevokeAccess("b.example.com")
+	if got.CanAccess("b.example.com") || !got.CanAccess("a.example.com") {
+		t.Errorf("RevokeAccess left grants %+v", got.Grants)
+	}
+	if got.LastSeen.IsZero() {
+		t.Errorf("GetUser should update LastSeen")
+	}
+
+	got.Admin = true
+	got.Name = "alice2"
+	if err := db.SetUser(*got); err != nil {
+		t.Fatalf("SetUser update: %v", err)
+	}
+
+	byName, err := db.GetUserByName("alice2")
+	if err != nil {
+		t.Fatalf("GetUserByName: %v", err)
+	}
+	if !byName.Admin || string(byName.ID) != "user-1" {
+		t.Errorf("GetUserByName returned %+v", byName)
+	}
+	if _, err := db.GetUserByName("alice"); !errors.Is(err, tobab.ErrNotFound) {
+		t.Errorf("GetUserByName on old name: got %v, want ErrNotFound", err)
+	}
+
+	if err := db.SetUser(tobab.User{ID: []byte("user-2"), Name: "bob"}); err != nil {
+		t.Fatalf("SetUser: %v", err)
+	}
+	users, err := db.GetUsers()
+	if err != nil {
+		t.Fatalf("GetUsers: %v", err)
+	}
+	if len(users) != 2 {
+		t.Errorf("GetUsers returned %d users, want 2", len(users))
+	}
+
+	if err := db.DeleteUser([]byte("user-1")); err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+	if _, err := db.GetUser([]byte("user-1")); !errors.Is(err, tobab.ErrNotFound) {
+		t.Errorf("GetUser after delete: got %v, want ErrNotFound", err)
+	}
+	if _, err := db.GetUserByName("alice2"); !errors.Is(err, tobab.ErrNotFound) {
+		t.Errorf("GetUserByName after delete: got %v, want ErrNotFound", err)
+	}
+	if err := db.DeleteUser([]byte("user-1")); !errors.Is(err, tobab.ErrNotFound) {
+		t.Errorf("DeleteUser on missing user: got %v, want ErrNotFound", err)
+	}
+	if err := db.SetUser(tobab.User{ID: []byte("user-3"), Name: "alice2"}); err != nil {
+		t.Errorf("SetUser with the name of a deleted user: %v", err)
+	}
+}
+
+func testUserNameUnique(t *testing.T, db tobab.Database) {
+	if err := db.SetUser(tobab.User{ID: []byte("user-1"), Name: "alice"}); err != nil {
+		t.Fatalf("SetUser: %v", err)
+	}
+	if err := db.SetUser(tobab.User{ID: []byte("user-2"), Name: "alice"}); err == nil {
+		t.Errorf("SetUser with duplicate name should fail")
+	}
+
+	u, err := db.GetUserByName("alice")
+	if err != nil {
+		t.Fatalf("GetUserByName: %v", err)
+	}
+	if string(u.ID) != "user-1" {
+		t.Errorf("duplicate name overwrote the original user")
+	}
+}
+
+func testUserNotFound(t *testing.T, db tobab.Database) {
+	if _, err := db.GetUser([]byte("missing")); !errors.Is(err, tobab.ErrNotFound) {
+		t.Errorf("GetUser on missing user: got %v, want ErrNotFound", err)
+	}
+	if _, err := db.GetUserByName("missing"); !errors.Is(err, tobab.ErrNotFound) {
+		t.Errorf("GetUserByName on missing user: got %v, want ErrNotFound", err)
+	}
+	users, err := db.GetUsers()
+	if err != nil {
+		t.Fatalf("GetUsers on empty database: %v", err)
+	}
+	if len(users) != 0 {
+		t.Errorf("GetUsers on empty database returned %d users", len(users))
+	}
+}
+
+func testSession(t *testing.T, db tobab.Database) {
+	s := newSession("sess-1", "null", time.Now().Add(time.Hour))
+	s.Vals["redirect_url"] = "https://a.example.com/"
+	if err := db.SetSession(s); err != nil {
+		t.Fatalf("SetSession: %v", err)
+	}
+
+	s.UserID = []byte("user-1")
+	s.FSM.SetState("authenticated")
+	if err := db.SetSession(s); err != nil {
+		t.Fatalf("SetSession update: %v", err)
+	}
+
+	got, err := db.GetSession("sess-1")
+	if err != nil {
+		t.Fatalf("GetSession: %v", err)
+	}
+	if got.State != "authenticated" {
+		t.Errorf("SetSession should store the FSM state, got %q", got.State)
+	}
+	if string(got.UserID) != "user-1" {
+		t.Errorf("GetSession UserID = %q, want %q", got.UserID, "user-1")
+	}
+	if got.Vals["redirect_url"] != "https://a.example.com/" {
+		t.Errorf("GetSession lost Vals: %v", got.Vals)
+	}
+}
+
+func testSessionNotFound(t *testing.T, db tobab.Database) {
+	if _, err := db.GetSession("missing"); !errors.Is(err, tobab.ErrNotFound) {
+		t.Errorf("GetSession on missing session: got %v, want ErrNotFound", err)
+	}
+}
+
+func testSessionsByUser(t *testing.T, db tobab.Database) {
+	sessions := []tobab.Session{
+		newSession("sess-1", "authenticated", time.Now().Add(time.Hour)),
+		newSession("sess-2", "authenticated", time.Now().Add(time.Hour)),
+		newSession("sess-3", "authenticated", time.Now().Add(time.Hour)),
+		newSession("anonymous", "null", time.Now().Add(time.Hour)),
+	}
+	sessions[0].UserID = []byte("user-1")
+	sessions[0].UserAgent = "Firefox"
+	sessions[0].IP = "192.0.2.1"
+	sessions[1].UserID = []byte("user-1")
+	sessions[2].UserID = []byte("user-2")
+	for _, s := range sessions {
+		if err := db.SetSession(s); err != nil {
+			t.Fatalf("SetSession: %v", err)
+		}
+	}
+
+	got, err := db.GetSessionsByUser([]byte("user-1"))
+	if err != nil {
+		t.Fatalf("GetSessionsByUser: %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("GetSessionsByUser returned %d sessions, want 2", len(got))
+	}
+	for _, s := range got {
+		if s.ID == "sess-1" && (s.UserAgent != "Firefox" || s.IP != "192.0.2.1") {
+			t.Errorf("GetSessionsByUser lost client details: %+v", s)
+		}
+	}
+
+	none, err := db.GetSessionsByUser([]byte("missing"))
+	if err != nil {
+		t.Errorf("GetSessionsByUser for user without sessions: %v", err)
+	}
+	if len(none) != 0 {
+		t.Errorf("GetSessionsByUser for user without sessions returned %d sessions", len(none))
+	}
+
+	if err := db.DeleteSession("sess-1"); err != nil {
+		t.Fatalf("DeleteSession: %v", err)
+	}
+	if _, err := db.GetSession("sess-1"); !errors.Is(err, tobab.ErrNotFound) {
+		t.Errorf("GetSession after delete: got %v, want ErrNotFound", err)
+	}
+	if got, _ := db.GetSessionsByUser([]byte("user-1")); len(got) != 1 {
+		t.Errorf("GetSessionsByUser after delete returned %d sessions, want 1", len(got))
+	}
+	if err := db.DeleteSession("sess-1"); !errors.Is(err, tobab.ErrNotFound) {
+		t.Errorf("DeleteSession on missing session: got %v, want ErrNotFound", err)
+	}
+
+	n, err := db.DeleteSessionsByUser([]byte("user-1"))
+	if err != nil {
+		t.Fatalf("DeleteSessionsByUser: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("DeleteSessionsByUser removed %d sessions, want 1", n)
+	}
+	if _, err := db.GetSession("sess-2"); !errors.Is(err, tobab.ErrNotFound) {
+		t.Errorf("session %q should be removed, got %v", "sess-2", err)
+	}
+	if _, err := db.GetSession("sess-3"); err != nil {
+		t.Errorf("session of another user should be kept, got %v", err)
+	}
+	if n, err := db.DeleteSessionsByUser([]byte("user-1")); err != nil || n != 0 {
+		t.Errorf("DeleteSessionsByUser without sessions: removed %d, error %v", n, err)
+	}
+}
+
+func testRotateSession(t *testing.T, db tobab.Database) {
+	s := newSession("old", "login", time.Now().Add(time.Hour))
+	s.UserID = []byte("user-1")
+	s.Vals["redirect_url"] = "https://a.example.com/"
+	if err := db.SetSession(s); err != nil {
+		t.Fatalf("SetSession: %v", err)
+	}
+
+	s.ID = "new"
+	s.FSM.SetState("authenticated")
+	if err := db.RotateSession("old", s); err != nil {
+		t.Fatalf("RotateSession: %v", err)
+	}
+	if _, err := db.GetSession("old"); !errors.Is(err, tobab.ErrNotFound) {
+		t.Errorf("GetSession on rotated session: got %v, want ErrNotFound", err)
+	}
+	got, err := db.GetSession("new")
+	if err != nil {
+		t.Fatalf("GetSession: %v", err)
+	}
+	if got.State != "authenticated" || got.Vals["redirect_url"] != "https://a.example.com/" {
+		t.Errorf("RotateSession lost session data: %+v", got)
+	}
+	if sessions, _ := db.GetSessionsByUser([]byte("user-1")); len(sessions) != 1 {
+		t.Errorf("GetSessionsByUser after rotate returned %d sessions, want 1", len(sessions))
+	}
+
+	s.ID = "newer"
+	if err := db.RotateSession("missing", s); err != nil {
+		t.Errorf("RotateSession without an old session: %v", err)
+	}
+}
+
+func testCleanupOldSessions(t *testing.T, db tobab.Database) {
+	sessions := []tobab.Session{
+		newSession("expired", "null", time.Now().Add(-time.Hour)),
+		newSession("expired-auth", "authenticated", time.Now().Add(-time.Second)),
+		newSession("valid", "authenticated", time.Now().Add(time.Hour)),
+	}
+	for _, s := range sessions {
+		if err := db.SetSession(s); err != nil {
+			t.Fatalf("SetSession: %v", err)
+		}
+	}
+
+	n, err := db.CountActiveSessions()
+	if err != nil {
+		t.Fatalf("CountActiveSessions: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("CountActiveSessions = %d, want 1", n)
+	}
+
+	n, err = db.CleanupOldSessions()
+	if err != nil {
+		t.Fatalf("CleanupOldSessions: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("CleanupOldSessions removed %d sessions, want 2", n)
+	}
+
+	n, err = db.CleanupOldSessions()
+	if err != nil {
+		t.Fatalf("CleanupOldSessions without expired sessions: %v", err)
+	}
+	if n != 0 {
+		t.Errorf("CleanupOldSessions without expired sessions removed %d sessions", n)
+	}
+
+	for _, id := range []string{"expired", "expired-auth"} {
+		if _, err := db.GetSession(id); !errors.Is(err, tobab.ErrNotFound) {
+			t.Errorf("session %q should be removed, got %v", id, err)
+		}
+	}
+	if _, err := db.GetSession("valid"); err != nil {
+		t.Errorf("session %q should be kept, got %v", "valid", err)
+	}
+}
+
+func testAPIKeys(t *testing.T, db tobab.Database) {
+	keys := []tobab.APIKey{
+		{ID: "key-1", UserID: []byte("user-1"), Name: "ci", Hash: tobab.HashSecret("secret-1"), Created: time.Now()},
+		{ID: "key-2", UserID: []byte("user-1"), Name: "laptop", Hash: tobab.HashSecret("secret-2"), Hosts: []string{"a.example.com"}},
+		{ID: "key-3", UserID: []byte("user-2"), Name: "other", Hash: tobab.HashSecret("secret-3")},
+	}
+	for _, k := range keys {
+		if err := db.SetAPIKey(k); err != nil {
+			t.Fatalf("SetAPIKey: %v", err)
+		}
+	}
+
+	got, err := db.GetAPIKeys([]byte("user-1"))
+	if err != nil {
+		t.Fatalf("GetAPIKeys: %v", err)
+	}
+	if len(got) != 2 {
+		t.Errorf("GetAPIKeys returned %d keys, want 2", len(got))
+	}
+
+	none, err := db.GetAPIKeys([]byte("missing"))
+	if err != nil {
+		t.Errorf("GetAPIKeys for user without keys: %v", err)
+	}
+	if len(none) != 0 {
+		t.Errorf("GetAPIKeys for user without keys returned %d keys", len(none))
+	}
+
+	k, err := db.GetAPIKeyByHash(tobab.HashSecret("secret-2"))
+	if err != nil {
+		t.Fatalf("GetAPIKeyByHash: %v", err)
+	}
+	if k.ID != "key-2" || !k.CanAccess("a.example.com") || k.CanAccess("b.example.com") {
+		t.Errorf("GetAPIKeyByHash returned %+v", k)
+	}
+
+	if err := db.DeleteAPIKey("key-2"); err != nil {
+		t.Fatalf("DeleteAPIKey: %v", err)
+	}
+	if _, err := db.GetAPIKeyByHash(tobab.HashSecret("secret-2")); !errors.Is(err, tobab.ErrNotFound) {
+		t.Errorf("GetAPIKeyByHash after delete: got %v, want ErrNotFound", err)
+	}
+	if err := db.DeleteAPIKey("key-2"); !errors.Is(err, tobab.ErrNotFound) {
+		t.Errorf("DeleteAPIKey on missing key: got %v, want ErrNotFound", err)
+	}
+}
+
+func testAccessRules(t *testing.T, db tobab.Database) {
+	rules, err := db.GetAccessRules()
+	if err != nil {
+		t.Fatalf("GetAccessRules on empty database: %v", err)
+	}
+	if len(rules) != 0 {
+		t.Errorf("GetAccessRules on empty database returned %d rules", len(rules))
+	}
+
+	for _, r := range []tobab.AccessRule{
+		{ID: "rule-1", Host: "a.example.com", Path: "/public/*", Methods: []string{"GET"}, Policy: tobab.POLICY_PUBLIC},
+		{ID: "rule-2", Host: "a.example.com", Path: "/api/admin/*", Policy: tobab.POLICY_USERS, Users: []string{"alice"}},
+	} {
+		if err := db.SetAccessRule(r); err != nil {
+			t.Fatalf("SetAccessRule: %v", err)
+		}
+	}
+
+	rules, err = db.GetAccessRules()
+	if err != nil {
+		t.Fatalf("GetAccessRules: %v", err)
+	}
+	if len(rules) != 2 {
+		t.Fatalf("GetAccessRules returned %d rules, want 2", len(rules))
+	}
+	if r := tobab.MatchAccessRule(rules, "a.example.com", "/public/index.html", "GET"); r == nil || r.ID != "rule-1" {
+		t.Errorf("stored rule does not match: %+v", r)
+	}
+
+	if err := db.DeleteAccessRule("rule-1"); err != nil {
+		t.Fatalf("DeleteAccessRule: %v", err)
+	}
+	if err := db.DeleteAccessRule("rule-1"); !errors.Is(err, tobab.ErrNotFound) {
+		t.Errorf("DeleteAccessRule on missing rule: got %v, want ErrNotFound", err)
+	}
+	rules, _ = db.GetAccessRules()
+	if len(rules) != 1 {
+		t.Errorf("GetAccessRules after delete returned %d rules, want 1", len(rules))
+	}
+}
+
+func testGroups(t *testing.T, db tobab.Database) {
+	for _, g := range []tobab.Group{
+		{ID: "group-1", Name: "ops", AccessibleHosts: []string{"a.example.com"}},
+		{ID: "group-2", Name: "dev"},
+	} {
+		if err := db.SetGroup(g); err != nil {
+			t.Fatalf("SetGroup: %v", err)
+		}
+	}
+	if err := db.SetGroup(tobab.Group{ID: "group-3", Name: "ops"}); err == nil {
+		t.Errorf("SetGroup with duplicate name should fail")
+	}
+
+	groups, err := db.GetGroups()
+	if err != nil {
+		t.Fatalf("GetGroups: %v", err)
+	}
+	if len(groups) != 2 {
+		t.Errorf("GetGroups returned %d groups, want 2", len(groups))
+	}
+
+	g, err := db.GetGroup("group-1")
+	if err != nil {
+		t.Fatalf("GetGroup: %v", err)
+	}
+	u := tobab.User{Name: "alice", Groups: []string{"group-1"}}
+	if g.Name != "ops" || !u.CanAccess("a.example.com", *g) {
+		t.Errorf("GetGroup returned %+v", g)
+	}
+
+	if err := db.DeleteGroup("group-1"); err != nil {
+		t.Fatalf("DeleteGroup: %v", err)
+	}
+	if _, err := db.GetGroup("group-1"); !errors.Is(err, tobab.ErrNotFound) {
+		t.Errorf("GetGroup after delete: got %v, want ErrNotFound", err)
+	}
+	if err := db.DeleteGroup("group-1"); !errors.Is(err, tobab.ErrNotFound) {
+		t.Errorf("DeleteGroup on missing group: got %v, want ErrNotFound", err)
+	}
+}
+
+func testOIDCClients(t *testing.T, db tobab.Database) {
+	for _, cl := range []tobab.OIDCClient{
+		{ID: "client-1", Name: "grafana", SecretHash: tobab.HashSecret("secret"), RedirectURIs: []string{"https://grafana.example.com/login/generic_oauth"}},
+		{ID: "client-2", Name: "cli"},
+	} {
+		if err := db.SetOIDCClient(cl); err != nil {
+			t.Fatalf("SetOIDCClient: %v", err)
+		}
+	}
+
+	clients, err := db.GetOIDCClients()
+	if err != nil {
+		t.Fatalf("GetOIDCClients: %v", err)
+	}
+	if len(clients) != 2 {
+		t.Errorf("GetOIDCClients returned %d clients, want 2", len(clients))
+	}
+
+	cl, err := db.GetOIDCClient("client-1")
+	if err != nil {
+		t.Fatalf("GetOIDCClient: %v", err)
+	}
+	if cl.Public() || !cl.AllowsRedirect("https://grafana.example.com/login/generic_oauth") {
+		t.Errorf("GetOIDCClient returned %+v", cl)
+	}
+
+	if err := db.DeleteOIDCClient("client-1"); err != nil {
+		t.Fatalf("DeleteOIDCClient: %v", err)
+	}
+	if _, err := db.GetOIDCClient("client-1"); !errors.Is(err, tobab.ErrNotFound) {
+		t.Errorf("GetOIDCClient after delete: got %v, want ErrNotFound", err)
+	}
+	if err := db.DeleteOIDCClient("client-1"); !errors.Is(err, tobab.ErrNotFound) {
+		t.Errorf("DeleteOIDCClient on missing client: got %v, want ErrNotFound", err)
+	}
+}
+
+func testInvites(t *testing.T, db tobab.Database) {
+	invites, err := db.GetInvites()
+	if err != nil {
+		t.Fatalf("GetInvites on empty database: %v", err)
+	}
+	if len(invites) != 0 {
+		t.Errorf("GetInvites on empty database returned %d invites", len(invites))
+	}
+
+	for _, inv := range []tobab.Invite{
+		{ID: "invite-1", Hash: tobab.HashSecret("token-1"), Note: "alice", Expires: time.Now().Add(time.Hour), Hosts: []string{"a.example.com"}},
+		{ID: "invite-2", Hash: tobab.HashSecret("token-2"), Expires: time.Now().Add(-time.Hour)},
+	} {
+		if err := db.SetInvite(inv); err != nil {
+			t.Fatalf("SetInvite: %v", err)
+		}
+	}
+
+	if err := db.SetInvite(tobab.Invite{ID: "invite-3", Hash: tobab.HashSecret("token-1")}); err == nil {
+		t.Errorf("SetInvite with duplicate hash succeeded")
+	}
+
+	invites, err = db.GetInvites()
+	if err != nil {
+		t.Fatalf("GetInvites: %v", err)
+	}
+	if len(invites) != 2 {
+		t.Errorf("GetInvites returned %d invites, want 2", len(invites))
+	}
+
+	inv, err := db.GetInviteByHash(tobab.HashSecret("token-1"))
+	if err != nil {
+		t.Fatalf("GetInviteByHash: %v", err)
+	}
+	if inv.ID != "invite-1" || inv.Expired() || !tobab.Contains(inv.Hosts, "a.example.com") {
+		t.Errorf("GetInviteByHash returned %+v", inv)
+	}
+
+	inv, err = db.GetInviteByHash(tobab.HashSecret("token-2"))
+	if err != nil {
+		t.Fatalf("GetInviteByHash: %v", err)
+	}
+	if !inv.Expired() {
+		t.Errorf("GetInviteByHash returned %+v, want an expired invite", inv)
+	}
+
+	if err := db.DeleteInvite("invite-1"); err != nil {
+		t.Fatalf("DeleteInvite: %v", err)
+	}
+	if _, err := db.GetInviteByHash(tobab.HashSecret("token-1")); !errors.Is(err, tobab.ErrNotFound) {
+		t.Errorf("GetInviteByHash after delete: got %v, want ErrNotFound", err)
+	}
+	if err := db.DeleteInvite("invite-1"); !errors.Is(err, tobab.ErrNotFound) {
+		t.Errorf("DeleteInvite on missing invite: got %v, want ErrNotFound", err)
+	}
+}
+
+func testHosts(t *testing.T, db tobab.Database) {
+	hosts := []tobab.Host{
+		{Name: "a.example.com", DisplayName: "Grafana", Owner: "alice", Policy: tobab.HOST_POLICY_PRIVATE, Created: time.Now()},
+		{Name: "b.example.com", Policy: tobab.HOST_POLICY_PUBLIC},
+		{Name: "scanner.example.com", Pending: true},
+	}
+	for _, h := range hosts {
+		if err := db.SetHost(h); err != nil {
+			t.Fatalf("SetHost: %v", err)
+		}
+	}
+
+	all, err := db.GetHosts()
+	if err != nil {
+		t.Fatalf("GetHosts: %v", err)
+	}
+	if len(all) != 3 {
+		t.Errorf("GetHosts returned %d hosts, want 3", len(all))
+	}
+
+	h, err := db.GetHost("a.example.com")
+	if err != nil {
+		t.Fatalf("GetHost: %v", err)
+	}
+	if h.Title() != "Grafana" || h.Owner != "alice" || h.Pending {
+		t.Errorf("GetHost returned %+v", h)
+	}
+
+	h.Description = "dashboards"
+	h.Policy = tobab.HOST_POLICY_AUTHENTICATED
+	if err := db.SetHost(*h); err != nil {
+		t.Fatalf("SetHost update: %v", err)
+	}
+	h, err = db.GetHost("a.example.com")
+	if err != nil {
+		t.Fatalf("GetHost after update: %v", err)
+	}
+	if h.Description != "dashboards" || h.Policy != tobab.HOST_POLICY_AUTHENTICATED {
+		t.Errorf("GetHost after update returned %+v", h)
+	}
+
+	if err := db.DeleteHost("scanner.example.com"); err != nil {
+		t.Fatalf("DeleteHost: %v", err)
+	}
+	if _, err := db.GetHost("scanner.example.com"); !errors.Is(err, tobab.ErrNotFound) {
+		t.Errorf("GetHost after delete: got %v, want ErrNotFound", err)
+	}
+	if err := db.DeleteHost("scanner.example.com"); !errors.Is(err, tobab.ErrNotFound) {
+		t.Errorf("DeleteHost on missing host: got %v, want ErrNotFound", err)
+	}
+}
+
+func testAccessRequests(t *testing.T, db tobab.Database) {
+	now := time.Now()
+	requests := []tobab.AccessRequest{
+		{ID: "req-1", UserID: []byte("user-1"), UserName: "alice", Host: "a.example.com", Status: tobab.ACCESS_REQUEST_PENDING, Created: now.Add(-time.Hour)},
+		{ID: "req-2", UserID: []byte("user-1"), UserName: "alice", Host: "b.example.com", Status: tobab.ACCESS_REQUEST_DENIED, Created: now.Add(-2 * time.Hour)},
+		{ID: "req-3", UserID: []byte("user-2"), UserName: "bob", Host: "a.example.com", Justification: "on call", Status: tobab.ACCESS_REQUEST_PENDING, Created: now},
+	}
+	for _, r := range requests {
+		if err := db.SetAccessRequest(r); err != nil {
+			t.Fatalf("SetAccessRequest: %v", err)
+		}
+	}
+
+	all, err := db.GetAccessRequests()
+	if err != nil {
+		t.Fatalf("GetAccessRequests: %v", err)
+	}
+	if len(all) != 3 {
+		t.Errorf("GetAccessRequests returned %d requests, want 3", len(all))
+	}
+
+	mine, err := db.GetAccessRequestsByUser([]byte("user-1"))
+	if err != nil {
+		t.Fatalf("GetAccessRequestsByUser: %v", err)
+	}
+	if len(mine) != 2 {
+		t.Errorf("GetAccessRequestsByUser returned %d requests, want 2", len(mine))
+	}
+
+	none, err := db.GetAccessRequestsByUser([]byte("missing"))
+	if err != nil {
+		t.Errorf("GetAccessRequestsByUser for user without requests: %v", err)
+	}
+	if len(none) != 0 {
+		t.Errorf("GetAccessRequestsByUser for user without requests returned %d requests", len(none))
+	}
+
+	r, err := db.GetAccessRequest("req-3")
+	if err != nil {
+		t.Fatalf("GetAccessRequest: %v", err)
+	}
+	if !r.Pending() || r.Justification != "on call" || r.UserName != "bob" {
+		t.Errorf("GetAccessRequest returned %+v", r)
+	}
+
+	r.Status = tobab.ACCESS_REQUEST_APPROVED
+	r.DecidedBy = "admin"
+	r.Decided = now
+	r.NotAfter = now.Add(time.Hour)
+	if err := db.SetAccessRequest(*r); err != nil {
+		t.Fatalf("SetAccessRequest update: %v", err)
+	}
+	r, err = db.GetAccessRequest("req-3")
+	if err != nil {
+		t.Fatalf("GetAccessRequest after update: %v", err)
+	}
+	if r.Pending() || r.DecidedBy != "admin" || !r.NotAfter.Equal(now.Add(time.Hour)) {
+		t.Errorf("GetAccessRequest after update returned %+v", r)
+	}
+
+	if _, err := db.GetAccessRequest("missing"); !errors.Is(err, tobab.ErrNotFound) {
+		t.Errorf("GetAccessRequest on missing request: got %v, want ErrNotFound", err)
+	}
+}
+
+func testAuditEvents(t *testing.T, db tobab.Database) {
+	events, err := db.GetAuditEvents(tobab.AuditFilter{})
+	if err != nil {
+		t.Fatalf("GetAuditEvents on empty database: %v", err)
+	}
+	if len(events) != 0 {
+		t.Errorf("GetAuditEvents on empty database returned %d events", len(events))
+	}
+
+	now := time.Now()
+	for _, e := range []tobab.AuditEvent{
+		{ID: "event-1", Time: now.Add(-3 * time.Hour), Type: tobab.AUDIT_LOGIN, Actor: "alice", IP: "192.0.2.1"},
+		{ID: "event-2", Time: now.Add(-2 * time.Hour), Type: tobab.AUDIT_TOGGLE_ACCESS, Actor: "alice", Target: "bob", Host: "a.example.com"},
+		{ID: "event-3", Time: now.Add(-time.Hour), Type: tobab.AUDIT_VERIFY_DENIED, Actor: "bob", Host: "b.example.com"},
+		{ID: "event-4", Time: now, Type: tobab.AUDIT_LOGIN, Actor: "bob"},
+	} {
+		if err := db.AddAuditEvent(e); err != nil {
+			t.Fatalf("AddAuditEvent: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		filter tobab.AuditFilter
+		want   []string
+	}{
+		{"all, newest first", tobab.AuditFilter{}, []string{"event-4", "event-3", "event-2", "event-1"}},
+		{"type", tobab.AuditFilter{Type: tobab.AUDIT_LOGIN}, []string{"event-4", "event-1"}},
+		{"user as actor or target", tobab.AuditFilter{User: "bob"}, []string{"event-4", "event-3", "event-2"}},
+		{"host", tobab.AuditFilter{Host: "a.example.com"}, []string{"event-2"}},
+		{"since", tobab.AuditFilter{Since: now.Add(-90 * time.Minute)}, []string{"event-4", "event-3"}},
+		{"limit", tobab.AuditFilter{Limit: 2}, []string{"event-4", "event-3"}},
+		{"combined", tobab.AuditFilter{Type: tobab.AUDIT_LOGIN, User: "alice"}, []string{"event-1"}},
+		{"no match", tobab.AuditFilter{User: "carol"}, nil},
+	}
+	for _, tc := range tests {
+		events, err := db.GetAuditEvents(tc.filter)
+		if err != nil {
+			t.Fatalf("%s: GetAuditEvents: %v", tc.name, err)
+		}
+		var got []string
+		for _, e := range events {
+			got = append(got, e.ID)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("%s: GetAuditEvents returned %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	events, err = db.GetAuditEvents(tobab.AuditFilter{Type: tobab.AUDIT_TOGGLE_ACCESS})
+	if err != nil || len(events) != 1 {
+		t.Fatalf("GetAuditEvents: %v, %d events", err, len(events))
+	}
+	if e := events[0]; e.Actor != "alice" || e.Target != "bob" || e.Host != "a.example.com" || !e.Time.Equal(now.Add(-2*time.Hour)) {
+		t.Errorf("GetAuditEvents returned %+v", e)
+	}
+}
+
+func testConcurrentWriters(t *testing.T, db tobab.Database) {
+	const writers = 8
+	const writes = 10
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers*writes*3)
+
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < writes; i++ {
+				id := fmt.Sprintf("%d-%d", w, i)
+				if err := db.KVSet("key-"+id, id); err != nil {
+					errs <- err
+				}
+				if err := db.SetUser(tobab.User{ID: []byte("user-" + id), Name: "name-" + id}); err != nil {
+					errs <- err
+				}
+				if err := db.SetSession(newSession("sess-"+id, "null", time.Now().Add(time.Hour))); err != nil {
+					errs <- err
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("concurrent write failed: %v", err)
+	}
+
+	users, err := db.GetUsers()
+	if err != nil {
+		t.Fatalf("GetUsers: %v", err)
+	}
+	if len(users) != writers*writes {
+		t.Errorf("GetUsers returned %d users, want %d", len(users), writers*writes)
+	}
+
+	for w := 0; w < writers; w++ {
+		for i := 0; i < writes; i++ {
+			id := fmt.Sprintf("%d-%d", w, i)
+			if s, err := db.KVGetString("key-" + id); err != nil || s != id {
+				t.Errorf("KVGetString(%q) = %q, %v", "key-"+id, s, err)
+			}
+			if _, err := db.GetSession("sess-" + id); err != nil {
+				t.Errorf("GetSession(%q): %v", "sess-"+id, err)
+			}
+		}
+	}
+}
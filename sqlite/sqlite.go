@@ -0,0 +1,458 @@
+package sqlite
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/gnur/tobab"
+	_ "modernc.org/sqlite"
+)
+
+// every table stores the full record as json in the data column, the other
+// columns only exist to allow lookups, constraints and indexes
+const schema = `
+CREATE TABLE IF NOT EXISTS kv (
+	key   TEXT PRIMARY KEY,
+	value BLOB NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS users (
+	id   BLOB PRIMARY KEY,
+	name TEXT NOT NULL UNIQUE,
+	data BLOB NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS sessions (
+	id      TEXT PRIMARY KEY,
+	user_id BLOB,
+	expires INTEGER NOT NULL,
+	state   TEXT NOT NULL,
+	data    BLOB NOT NULL
+);
+CREATE INDEX IF NOT EXISTS sessions_expires ON sessions (expires);
+CREATE INDEX IF NOT EXISTS sessions_user_id ON sessions (user_id);
+
+CREATE TABLE IF NOT EXISTS api_keys (
+	id      TEXT PRIMARY KEY,
+	user_id BLOB NOT NULL,
+	hash    TEXT NOT NULL UNIQUE,
+	data    BLOB NOT NULL
+);
+CREATE INDEX IF NOT EXISTS api_keys_user_id ON api_keys (user_id);
+
+CREATE TABLE IF NOT EXISTS access_rules (
+	id   TEXT PRIMARY KEY,
+	host TEXT NOT NULL,
+	data BLOB NOT NULL
+);
+CREATE INDEX IF NOT EXISTS access_rules_host ON access_rules (host);
+
+CREATE TABLE IF NOT EXISTS groups (
+	id   TEXT PRIMARY KEY,
+	name TEXT NOT NULL UNIQUE,
+	data BLOB NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS oidc_clients (
+	id   TEXT PRIMARY KEY,
+	data BLOB NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS invites (
+	id   TEXT PRIMARY KEY,
+	hash TEXT NOT NULL UNIQUE,
+	data BLOB NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS hosts (
+	name TEXT PRIMARY KEY,
+	data BLOB NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS access_requests (
+	id      TEXT PRIMARY KEY,
+	user_id BLOB NOT NULL,
+	created INTEGER NOT NULL,
+	data    BLOB NOT NULL
+);
+CREATE INDEX IF NOT EXISTS access_requests_user_id ON access_requests (user_id);
+
+CREATE TABLE IF NOT EXISTS audit_events (
+	id     TEXT PRIMARY KEY,
+	time   INTEGER NOT NULL,
+	type   TEXT NOT NULL,
+	actor  TEXT NOT NULL,
+	target TEXT NOT NULL,
+	host   TEXT NOT NULL,
+	data   BLOB NOT NULL
+);
+CREATE INDEX IF NOT EXISTS audit_events_time ON audit_events (time);
+`
+
+type sqliteDB struct {
+	db *sql.DB
+}
+
+func New(path string) (*sqliteDB, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(schema)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	database := sqliteDB{
+		db: db,
+	}
+
+	return &database, nil
+}
+
+// convertErr maps database/sql specific errors onto the errors defined by tobab
+func convertErr(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return tobab.ErrNotFound
+	}
+	return err
+}
+
+// selectAll runs query and decodes the data column of every returned row
+func selectAll[T any](db *sql.DB, query string, args ...any) ([]T, error) {
+	var res []T
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var b []byte
+		var v T
+		if err := rows.Scan(&b); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(b, &v); err != nil {
+			return nil, err
+		}
+		res = append(res, v)
+	}
+	return res, rows.Err()
+}
+
+// selectOne runs query and decodes the data column of the returned row
+func selectOne[T any](db *sql.DB, query string, args ...any) (*T, error) {
+	var v T
+	var b []byte
+
+	err := db.QueryRow(query, args...).Scan(&b)
+	if err != nil {
+		return &v, convertErr(err)
+	}
+	err = json.Unmarshal(b, &v)
+	return &v, err
+}
+
+// save executes an insert or update query, v is encoded and passed as the last argument
+func (db *sqliteDB) save(query string, v any, args ...any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = db.db.Exec(query, append(args, b)...)
+	return err
+}
+
+// delete executes a delete query and returns tobab.ErrNotFound if nothing was removed
+func (db *sqliteDB) delete(query string, args ...any) error {
+	res, err := db.db.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return tobab.ErrNotFound
+	}
+	return nil
+}
+
+func (db *sqliteDB) KVSet(k string, v any) error {
+	return db.save(`INSERT INTO kv (key, value) VALUES (?, ?)
+		ON CONFLICT (key) DO UPDATE SET value = excluded.value`, v, k)
+}
+
+func (db *sqliteDB) KVGetString(k string) (string, error) {
+	var s string
+	err := db.KVGet(k, &s)
+	return s, err
+}
+
+func (db *sqliteDB) KVGetBool(k string) (bool, error) {
+	var b bool
+	err := db.KVGet(k, &b)
+	return b, err
+}
+
+func (db *sqliteDB) KVGet(k string, v any) error {
+	var b []byte
+	err := db.db.QueryRow(`SELECT value FROM kv WHERE key = ?`, k).Scan(&b)
+	if err != nil {
+		return convertErr(err)
+	}
+	return json.Unmarshal(b, v)
+}
+
+func (db *sqliteDB) Close() {
+	db.db.Close()
+}
+
+func (db *sqliteDB) GetUsers() ([]tobab.User, error) {
+	return selectAll[tobab.User](db.db, `SELECT data FROM users ORDER BY name`)
+}
+
+func (db *sqliteDB) GetUser(id []byte) (*tobab.User, error) {
+	u, err := selectOne[tobab.User](db.db, `SELECT data FROM users WHERE id = ?`, id)
+	if err == nil {
+		u.LastSeen = time.Now()
+		db.SetUser(*u)
+	}
+	return u, err
+}
+
+func (db *sqliteDB) GetUserByName(name string) (*tobab.User, error) {
+	return selectOne[tobab.User](db.db, `SELECT data FROM users WHERE name = ?`, name)
+}
+
+func (db *sqliteDB) SetUser(u tobab.User) error {
+	return db.save(`INSERT INTO users (id, name, data) VALUES (?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET name = excluded.name, data = excluded.data`, u, u.ID, u.Name)
+}
+
+func (db *sqliteDB) DeleteUser(id []byte) error {
+	return db.delete(`DELETE FROM users WHERE id = ?`, id)
+}
+
+func (db *sqliteDB) GetSession(id string) (*tobab.Session, error) {
+	return selectOne[tobab.Session](db.db, `SELECT data FROM sessions WHERE id = ?`, id)
+}
+
+func (db *sqliteDB) GetSessionsByUser(userID []byte) ([]tobab.Session, error) {
+	return selectAll[tobab.Session](db.db, `SELECT data FROM sessions WHERE user_id = ? ORDER BY id`, userID)
+}
+
+func (db *sqliteDB) DeleteSession(id string) error {
+	return db.delete(`DELETE FROM sessions WHERE id = ?`, id)
+}
+
+func (db *sqliteDB) DeleteSessionsByUser(userID []byte) (int, error) {
+	res, err := db.db.Exec(`DELETE FROM sessions WHERE user_id = ?`, userID)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+const saveSession = `INSERT INTO sessions (id, user_id, expires, state, data) VALUES (?, ?, ?, ?, ?)
+	ON CONFLICT (id) DO UPDATE SET user_id = excluded.user_id, expires = excluded.expires, state = excluded.state, data = excluded.data`
+
+func (db *sqliteDB) SetSession(s tobab.Session) error {
+	s.State = s.FSM.Current()
+	return db.save(saveSession, s, s.ID, s.UserID, s.Expires.Unix(), s.State)
+}
+
+// RotateSession stores s and removes the session with oldID in one transaction
+func (db *sqliteDB) RotateSession(oldID string, s tobab.Session) error {
+	s.State = s.FSM.Current()
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`DELETE FROM sessions WHERE id = ?`, oldID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(saveSession, s.ID, s.UserID, s.Expires.Unix(), s.State, b)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (db *sqliteDB) CleanupOldSessions() (int, error) {
+	res, err := db.db.Exec(`DELETE FROM sessions WHERE expires <= ?`, time.Now().Unix())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func (db *sqliteDB) CountActiveSessions() (int, error) {
+	var n int
+	err := db.db.QueryRow(`SELECT COUNT(*) FROM sessions WHERE expires > ? AND state = 'authenticated'`, time.Now().Unix()).Scan(&n)
+	return n, err
+}
+
+func (db *sqliteDB) GetAPIKeys(userID []byte) ([]tobab.APIKey, error) {
+	return selectAll[tobab.APIKey](db.db, `SELECT data FROM api_keys WHERE user_id = ? ORDER BY id`, userID)
+}
+
+func (db *sqliteDB) GetAPIKeyByHash(hash string) (*tobab.APIKey, error) {
+	return selectOne[tobab.APIKey](db.db, `SELECT data FROM api_keys WHERE hash = ?`, hash)
+}
+
+func (db *sqliteDB) SetAPIKey(k tobab.APIKey) error {
+	return db.save(`INSERT INTO api_keys (id, user_id, hash, data) VALUES (?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET user_id = excluded.user_id, hash = excluded.hash, data = excluded.data`, k, k.ID, k.UserID, k.Hash)
+}
+
+func (db *sqliteDB) DeleteAPIKey(id string) error {
+	return db.delete(`DELETE FROM api_keys WHERE id = ?`, id)
+}
+
+func (db *sqliteDB) GetAccessRules() ([]tobab.AccessRule, error) {
+	return selectAll[tobab.AccessRule](db.db, `SELECT data FROM access_rules ORDER BY id`)
+}
+
+func (db *sqliteDB) SetAccessRule(r tobab.AccessRule) error {
+	return db.save(`INSERT INTO access_rules (id, host, data) VALUES (?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET host = excluded.host, data = excluded.data`, r, r.ID, r.Host)
+}
+
+func (db *sqliteDB) DeleteAccessRule(id string) error {
+	return db.delete(`DELETE FROM access_rules WHERE id = ?`, id)
+}
+
+func (db *sqliteDB) GetGroups() ([]tobab.Group, error) {
+	return selectAll[tobab.Group](db.db, `SELECT data FROM groups ORDER BY name`)
+}
+
+func (db *sqliteDB) GetGroup(id string) (*tobab.Group, error) {
+	return selectOne[tobab.Group](db.db, `SELECT data FROM groups WHERE id = ?`, id)
+}
+
+func (db *sqliteDB) SetGroup(g tobab.Group) error {
+	return db.save(`INSERT INTO groups (id, name, data) VALUES (?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET name = excluded.name, data = excluded.data`, g, g.ID, g.Name)
+}
+
+func (db *sqliteDB) DeleteGroup(id string) error {
+	return db.delete(`DELETE FROM groups WHERE id = ?`, id)
+}
+
+func (db *sqliteDB) GetOIDCClients() ([]tobab.OIDCClient, error) {
+	return selectAll[tobab.OIDCClient](db.db, `SELECT data FROM oidc_clients ORDER BY id`)
+}
+
+func (db *sqliteDB) GetOIDCClient(id string) (*tobab.OIDCClient, error) {
+	return selectOne[tobab.OIDCClient](db.db, `SELECT data FROM oidc_clients WHERE id = ?`, id)
+}
+
+func (db *sqliteDB) SetOIDCClient(cl tobab.OIDCClient) error {
+	return db.save(`INSERT INTO oidc_clients (id, data) VALUES (?, ?)
+		ON CONFLICT (id) DO UPDATE SET data = excluded.data`, cl, cl.ID)
+}
+
+func (db *sqliteDB) DeleteOIDCClient(id string) error {
+	return db.delete(`DELETE FROM oidc_clients WHERE id = ?`, id)
+}
+
+func (db *sqliteDB) GetInvites() ([]tobab.Invite, error) {
+	return selectAll[tobab.Invite](db.db, `SELECT data FROM invites ORDER BY id`)
+}
+
+func (db *sqliteDB) GetInviteByHash(hash string) (*tobab.Invite, error) {
+	return selectOne[tobab.Invite](db.db, `SELECT data FROM invites WHERE hash = ?`, hash)
+}
+
+func (db *sqliteDB) SetInvite(inv tobab.Invite) error {
+	return db.save(`INSERT INTO invites (id, hash, data) VALUES (?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET hash = excluded.hash, data = excluded.data`, inv, inv.ID, inv.Hash)
+}
+
+func (db *sqliteDB) DeleteInvite(id string) error {
+	return db.delete(`DELETE FROM invites WHERE id = ?`, id)
+}
+
+func (db *sqliteDB) GetHosts() ([]tobab.Host, error) {
+	return selectAll[tobab.Host](db.db, `SELECT data FROM hosts ORDER BY name`)
+}
+
+func (db *sqliteDB) GetHost(name string) (*tobab.Host, error) {
+	return selectOne[tobab.Host](db.db, `SELECT data FROM hosts WHERE name = ?`, name)
+}
+
+func (db *sqliteDB) SetHost(h tobab.Host) error {
+	return db.save(`INSERT INTO hosts (name, data) VALUES (?, ?)
+		ON CONFLICT (name) DO UPDATE SET data = excluded.data`, h, h.Name)
+}
+
+func (db *sqliteDB) DeleteHost(name string) error {
+	return db.delete(`DELETE FROM hosts WHERE name = ?`, name)
+}
+
+func (db *sqliteDB) GetAccessRequests() ([]tobab.AccessRequest, error) {
+	return selectAll[tobab.AccessRequest](db.db, `SELECT data FROM access_requests ORDER BY created`)
+}
+
+func (db *sqliteDB) GetAccessRequestsByUser(userID []byte) ([]tobab.AccessRequest, error) {
+	return selectAll[tobab.AccessRequest](db.db, `SELECT data FROM access_requests WHERE user_id = ? ORDER BY created`, userID)
+}
+
+func (db *sqliteDB) GetAccessRequest(id string) (*tobab.AccessRequest, error) {
+	return selectOne[tobab.AccessRequest](db.db, `SELECT data FROM access_requests WHERE id = ?`, id)
+}
+
+func (db *sqliteDB) SetAccessRequest(r tobab.AccessRequest) error {
+	return db.save(`INSERT INTO access_requests (id, user_id, created, data) VALUES (?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET user_id = excluded.user_id, created = excluded.created, data = excluded.data`, r, r.ID, r.UserID, r.Created.UnixNano())
+}
+
+func (db *sqliteDB) AddAuditEvent(e tobab.AuditEvent) error {
+	return db.save(`INSERT INTO audit_events (id, time, type, actor, target, host, data) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		e, e.ID, e.Time.UnixNano(), e.Type, e.Actor, e.Target, e.Host)
+}
+
+func (db *sqliteDB) GetAuditEvents(f tobab.AuditFilter) ([]tobab.AuditEvent, error) {
+	query := `SELECT data FROM audit_events WHERE 1 = 1`
+	var args []any
+	if f.Type != "" {
+		query += ` AND type = ?`
+		args = append(args, f.Type)
+	}
+	if f.User != "" {
+		query += ` AND (actor = ? OR target = ?)`
+		args = append(args, f.User, f.User)
+	}
+	if f.Host != "" {
+		query += ` AND host = ?`
+		args = append(args, f.Host)
+	}
+	if !f.Since.IsZero() {
+		query += ` AND time >= ?`
+		args = append(args, f.Since.UnixNano())
+	}
+	query += ` ORDER BY time DESC`
+	if f.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, f.Limit)
+	}
+	return selectAll[tobab.AuditEvent](db.db, query, args...)
+}
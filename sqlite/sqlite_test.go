@@ -0,0 +1,19 @@
+package sqlite
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/gnur/tobab"
+	"github.com/gnur/tobab/dbtest"
+)
+
+func TestConformance(t *testing.T) {
+	dbtest.Run(t, func(t *testing.T) tobab.Database {
+		db, err := New(filepath.Join(t.TempDir(), "tobab.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	})
+}
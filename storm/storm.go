@@ -1,12 +1,12 @@
 package storm
 
 import (
-	"fmt"
 	"time"
 
 	"github.com/asdine/storm"
 	"github.com/asdine/storm/q"
 	"github.com/gnur/tobab"
+	bolt "go.etcd.io/bbolt"
 )
 
 type stormDB struct {
@@ -14,7 +14,8 @@ type stormDB struct {
 }
 
 func New(path string) (*stormDB, error) {
-	db, err := storm.Open(path)
+	//bolt only allows a single process to open the database, fail instead of waiting forever when tobab is already running
+	db, err := storm.Open(path, storm.BoltOptions(0600, &bolt.Options{Timeout: 5 * time.Second}))
 	if err != nil {
 		return nil, err
 	}
@@ -26,21 +27,29 @@ func New(path string) (*stormDB, error) {
 	return &database, nil
 }
 
+// convertErr maps storm specific errors onto the errors defined by tobab
+func convertErr(err error) error {
+	if err == storm.ErrNotFound {
+		return tobab.ErrNotFound
+	}
+	return err
+}
+
 func (db *stormDB) KVSet(k string, v any) error {
 	return db.db.Set("tobab", k, v)
 }
 func (db *stormDB) KVGetString(k string) (string, error) {
 	var s string
 	err := db.db.Get("tobab", k, &s)
-	return s, err
+	return s, convertErr(err)
 }
 func (db *stormDB) KVGetBool(k string) (bool, error) {
 	var b bool
 	err := db.db.Get("tobab", k, &b)
-	return b, err
+	return b, convertErr(err)
 }
 func (db *stormDB) KVGet(k string, v any) error {
-	return db.db.Get("tobab", k, &v)
+	return convertErr(db.db.Get("tobab", k, v))
 }
 
 func (db *stormDB) Close() {
@@ -60,23 +69,58 @@ func (db *stormDB) GetUser(id []byte) (*tobab.User, error) {
 		u.LastSeen = time.Now()
 		db.SetUser(u)
 	}
-	return &u, err
+	return &u, convertErr(err)
 }
 
 func (db *stormDB) GetUserByName(id string) (*tobab.User, error) {
 	var u tobab.User
 	err := db.db.One("Name", id, &u)
-	return &u, err
+	return &u, convertErr(err)
 }
 
 func (db *stormDB) SetUser(u tobab.User) error {
 	return db.db.Save(&u)
 }
 
+func (db *stormDB) DeleteUser(id []byte) error {
+	return convertErr(db.db.DeleteStruct(&tobab.User{ID: id}))
+}
+
 func (db *stormDB) GetSession(id string) (*tobab.Session, error) {
 	var s tobab.Session
 	err := db.db.One("ID", id, &s)
-	return &s, err
+	return &s, convertErr(err)
+}
+
+func (db *stormDB) GetSessionsByUser(userID []byte) ([]tobab.Session, error) {
+	var sess []tobab.Session
+	err := db.db.Find("UserID", userID, &sess)
+	if err == storm.ErrNotFound {
+		return sess, nil
+	}
+	return sess, err
+}
+
+func (db *stormDB) DeleteSession(id string) error {
+	return convertErr(db.db.DeleteStruct(&tobab.Session{ID: id}))
+}
+
+func (db *stormDB) DeleteSessionsByUser(userID []byte) (int, error) {
+	var sess []tobab.Session
+	err := db.db.Find("UserID", userID, &sess)
+	if err == storm.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	for _, s := range sess {
+		err = db.db.DeleteStruct(&s)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(sess), nil
 }
 
 func (db *stormDB) SetSession(s tobab.Session) error {
@@ -84,12 +128,219 @@ func (db *stormDB) SetSession(s tobab.Session) error {
 	return db.db.Save(&s)
 }
 
-func (db *stormDB) CleanupOldSessions() {
+// RotateSession stores s and removes the session with oldID in one transaction
+func (db *stormDB) RotateSession(oldID string, s tobab.Session) error {
+	s.State = s.FSM.Current()
+	tx, err := db.db.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.DeleteStruct(&tobab.Session{ID: oldID})
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+	err = tx.Save(&s)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (db *stormDB) CleanupOldSessions() (int, error) {
 	var sess []tobab.Session
 	q := db.db.Select(q.Lte("Expires", time.Now()))
-	q.Find(&sess)
+	err := q.Find(&sess)
+	if err == storm.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
 	for _, s := range sess {
-		fmt.Println(s.Expires)
-		db.db.DeleteStruct(&s)
+		err = db.db.DeleteStruct(&s)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(sess), nil
+}
+
+func (db *stormDB) CountActiveSessions() (int, error) {
+	return db.db.Select(q.Gt("Expires", time.Now()), q.Eq("State", "authenticated")).Count(&tobab.Session{})
+}
+
+func (db *stormDB) GetAPIKeys(userID []byte) ([]tobab.APIKey, error) {
+	var keys []tobab.APIKey
+	err := db.db.Find("UserID", userID, &keys)
+	if err == storm.ErrNotFound {
+		return keys, nil
+	}
+	return keys, err
+}
+
+func (db *stormDB) GetAPIKeyByHash(hash string) (*tobab.APIKey, error) {
+	var k tobab.APIKey
+	err := db.db.One("Hash", hash, &k)
+	return &k, convertErr(err)
+}
+
+func (db *stormDB) SetAPIKey(k tobab.APIKey) error {
+	return db.db.Save(&k)
+}
+
+func (db *stormDB) DeleteAPIKey(id string) error {
+	return convertErr(db.db.DeleteStruct(&tobab.APIKey{ID: id}))
+}
+
+func (db *stormDB) GetAccessRules() ([]tobab.AccessRule, error) {
+	var rules []tobab.AccessRule
+	err := db.db.All(&rules)
+	return rules, err
+}
+
+func (db *stormDB) SetAccessRule(r tobab.AccessRule) error {
+	return db.db.Save(&r)
+}
+
+func (db *stormDB) DeleteAccessRule(id string) error {
+	return convertErr(db.db.DeleteStruct(&tobab.AccessRule{ID: id}))
+}
+
+func (db *stormDB) GetGroups() ([]tobab.Group, error) {
+	var groups []tobab.Group
+	err := db.db.All(&groups)
+	return groups, err
+}
+
+func (db *stormDB) GetGroup(id string) (*tobab.Group, error) {
+	var g tobab.Group
+	err := db.db.One("ID", id, &g)
+	return &g, convertErr(err)
+}
+
+func (db *stormDB) SetGroup(g tobab.Group) error {
+	return db.db.Save(&g)
+}
+
+func (db *stormDB) DeleteGroup(id string) error {
+	return convertErr(db.db.DeleteStruct(&tobab.Group{ID: id}))
+}
+
+func (db *stormDB) GetOIDCClients() ([]tobab.OIDCClient, error) {
+	var clients []tobab.OIDCClient
+	err := db.db.All(&clients)
+	return clients, err
+}
+
+func (db *stormDB) GetOIDCClient(id string) (*tobab.OIDCClient, error) {
+	var cl tobab.OIDCClient
+	err := db.db.One("ID", id, &cl)
+	return &cl, convertErr(err)
+}
+
+func (db *stormDB) SetOIDCClient(cl tobab.OIDCClient) error {
+	return db.db.Save(&cl)
+}
+
+func (db *stormDB) DeleteOIDCClient(id string) error {
+	return convertErr(db.db.DeleteStruct(&tobab.OIDCClient{ID: id}))
+}
+
+func (db *stormDB) GetInvites() ([]tobab.Invite, error) {
+	var invites []tobab.Invite
+	err := db.db.All(&invites)
+	return invites, err
+}
+
+func (db *stormDB) GetInviteByHash(hash string) (*tobab.Invite, error) {
+	var inv tobab.Invite
+	err := db.db.One("Hash", hash, &inv)
+	return &inv, convertErr(err)
+}
+
+func (db *stormDB) SetInvite(inv tobab.Invite) error {
+	return db.db.Save(&inv)
+}
+
+func (db *stormDB) DeleteInvite(id string) error {
+	return convertErr(db.db.DeleteStruct(&tobab.Invite{ID: id}))
+}
+
+func (db *stormDB) GetHosts() ([]tobab.Host, error) {
+	var hosts []tobab.Host
+	err := db.db.All(&hosts)
+	return hosts, err
+}
+
+func (db *stormDB) GetHost(name string) (*tobab.Host, error) {
+	var h tobab.Host
+	err := db.db.One("Name", name, &h)
+	return &h, convertErr(err)
+}
+
+func (db *stormDB) SetHost(h tobab.Host) error {
+	return db.db.Save(&h)
+}
+
+func (db *stormDB) DeleteHost(name string) error {
+	return convertErr(db.db.DeleteStruct(&tobab.Host{Name: name}))
+}
+
+func (db *stormDB) GetAccessRequests() ([]tobab.AccessRequest, error) {
+	var requests []tobab.AccessRequest
+	err := db.db.All(&requests)
+	return requests, err
+}
+
+func (db *stormDB) GetAccessRequestsByUser(userID []byte) ([]tobab.AccessRequest, error) {
+	var requests []tobab.AccessRequest
+	err := db.db.Find("UserID", userID, &requests)
+	if err == storm.ErrNotFound {
+		return requests, nil
+	}
+	return requests, err
+}
+
+func (db *stormDB) GetAccessRequest(id string) (*tobab.AccessRequest, error) {
+	var r tobab.AccessRequest
+	err := db.db.One("ID", id, &r)
+	return &r, convertErr(err)
+}
+
+func (db *stormDB) SetAccessRequest(r tobab.AccessRequest) error {
+	return db.db.Save(&r)
+}
+
+func (db *stormDB) AddAuditEvent(e tobab.AuditEvent) error {
+	return db.db.Save(&e)
+}
+
+func (db *stormDB) GetAuditEvents(f tobab.AuditFilter) ([]tobab.AuditEvent, error) {
+	var matchers []q.Matcher
+	if f.Type != "" {
+		matchers = append(matchers, q.Eq("Type", f.Type))
+	}
+	if f.User != "" {
+		matchers = append(matchers, q.Or(q.Eq("Actor", f.User), q.Eq("Target", f.User)))
+	}
+	if f.Host != "" {
+		matchers = append(matchers, q.Eq("Host", f.Host))
+	}
+	if !f.Since.IsZero() {
+		matchers = append(matchers, q.Gte("Time", f.Since))
+	}
+
+	query := db.db.Select(matchers...).OrderBy("Time").Reverse()
+	if f.Limit > 0 {
+		query = query.Limit(f.Limit)
+	}
+
+	var events []tobab.AuditEvent
+	err := query.Find(&events)
+	if err == storm.ErrNotFound {
+		return events, nil
 	}
+	return events, err
 }
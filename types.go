@@ -1,7 +1,11 @@
 package tobab
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"path"
 	"strings"
 	"time"
 
@@ -21,6 +25,15 @@ type Config struct {
 	CookieScope     string `valid:"required"`
 	Loglevel        string
 	DatabasePath    string `valid:"required"`
+	DatabaseType    string `valid:"in(storm|sqlite)"`
+	JWTHeader       string
+	JWTAge          string
+	JWTKeyRotation  string
+	InviteOnly      bool
+	MetricsAddress  string
+	ExtAuthzAddress string
+	AuditLog        string
+	TrustedProxies  []string
 }
 
 type User struct {
@@ -30,15 +43,163 @@ type User struct {
 	Created              time.Time
 	LastSeen             time.Time
 	Admin                bool
+	Disabled             bool
 	AccessibleHosts      []string
+	Grants               []Grant
+	Groups               []string
+	Favorites            []string
+	Visits               map[string]time.Time
 	Creds                []webauthn.Credential
+	CredInfo             map[string]CredentialInfo
 }
 
-func (user *User) CanAccess(h string) bool {
+// Grant gives a user access to Host between NotBefore and NotAfter, either can be zero for no bound
+type Grant struct {
+	Host      string
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+// Valid reports whether the grant has started and not ended yet
+func (g *Grant) Valid() bool {
+	now := time.Now()
+	return !now.Before(g.NotBefore) && !g.Expired()
+}
+
+// Expired reports whether the grant has an end that has passed
+func (g *Grant) Expired() bool {
+	return !g.NotAfter.IsZero() && time.Now().After(g.NotAfter)
+}
+
+// CredentialInfo is what tobab keeps about a passkey next to the webauthn credential, keyed by CredentialID
+type CredentialInfo struct {
+	Name     string
+	Created  time.Time
+	LastUsed time.Time
+}
+
+// CredentialID returns the url safe representation of the ID of c
+func CredentialID(c webauthn.Credential) string {
+	return base64.RawURLEncoding.EncodeToString(c.ID)
+}
+
+// CanAccess reports whether the user has been granted h directly or through one of the provided groups it is a member of
+func (user *User) CanAccess(h string, groups ...Group) bool {
 	if user.Admin {
 		return true
 	}
-	return Contains(user.AccessibleHosts, h)
+	if Contains(user.AccessibleHosts, h) {
+		return true
+	}
+	for _, g := range user.Grants {
+		if g.Host == h && g.Valid() {
+			return true
+		}
+	}
+	for _, g := range groups {
+		if user.MemberOf(g) && Contains(g.AccessibleHosts, h) {
+			return true
+		}
+	}
+	return false
+}
+
+func (user *User) MemberOf(g Group) bool {
+	return Contains(user.Groups, g.ID)
+}
+
+// GrantAccess gives the user access to g.Host, replacing earlier grants for that host, a grant without bounds is permanent
+func (user *User) GrantAccess(g Grant) {
+	user.RevokeAccess(g.Host)
+	if g.NotBefore.IsZero() && g.NotAfter.IsZero() {
+		user.AccessibleHosts = append(user.AccessibleHosts, g.Host)
+		return
+	}
+	user.Grants = append(user.Grants, g)
+}
+
+// Grant returns the time limited grant the user has for h, or nil when access to h is permanent or not granted
+func (user *User) Grant(h string) *Grant {
+	for _, g := range user.Grants {
+		if g.Host == h {
+			return &g
+		}
+	}
+	return nil
+}
+
+// PruneGrants removes the grants that have ended and returns them
+func (user *User) PruneGrants() []Grant {
+	var expired []Grant
+	grants := []Grant{}
+	for _, g := range user.Grants {
+		if g.Expired() {
+			expired = append(expired, g)
+			continue
+		}
+		grants = append(grants, g)
+	}
+	user.Grants = grants
+	return expired
+}
+
+// RevokeAccess removes every direct grant the user has for h
+func (user *User) RevokeAccess(h string) {
+	hosts := []string{}
+	for _, host := range user.AccessibleHosts {
+		if host != h {
+			hosts = append(hosts, host)
+		}
+	}
+	user.AccessibleHosts = hosts
+
+	grants := []Grant{}
+	for _, g := range user.Grants {
+		if g.Host != h {
+			grants = append(grants, g)
+		}
+	}
+	user.Grants = grants
+}
+
+// AddCredential stores a newly registered passkey under the provided name
+func (user *User) AddCredential(c webauthn.Credential, name string) {
+	if user.CredInfo == nil {
+		user.CredInfo = make(map[string]CredentialInfo)
+	}
+	user.Creds = append(user.Creds, c)
+	user.CredInfo[CredentialID(c)] = CredentialInfo{
+		Name:    name,
+		Created: time.Now(),
+	}
+}
+
+// CredentialUsed replaces the stored passkey with c after a login so the sign count stays current
+func (user *User) CredentialUsed(c webauthn.Credential) {
+	id := CredentialID(c)
+	for i := range user.Creds {
+		if CredentialID(user.Creds[i]) == id {
+			user.Creds[i] = c
+		}
+	}
+	if user.CredInfo == nil {
+		user.CredInfo = make(map[string]CredentialInfo)
+	}
+	info := user.CredInfo[id]
+	info.LastUsed = time.Now()
+	user.CredInfo[id] = info
+}
+
+// RemoveCredential deletes the passkey with id, it reports whether the passkey existed
+func (user *User) RemoveCredential(id string) bool {
+	for i := range user.Creds {
+		if CredentialID(user.Creds[i]) == id {
+			user.Creds = append(user.Creds[:i], user.Creds[i+1:]...)
+			delete(user.CredInfo, id)
+			return true
+		}
+	}
+	return false
 }
 
 func (user *User) WebAuthnID() []byte {
@@ -61,16 +222,155 @@ func (user *User) WebAuthnCredentials() []webauthn.Credential {
 	return user.Creds
 }
 
+type Group struct {
+	ID              string `storm:"id"`
+	Name            string `storm:"unique"`
+	Description     string
+	Created         time.Time
+	AccessibleHosts []string
+}
+
 type Session struct {
+	ID        string `storm:"id"`
+	UserID    []byte `storm:"index"`
+	Created   time.Time
+	LastSeen  time.Time
+	Expires   time.Time `storm:"index"`
+	UserAgent string
+	IP        string
+	Vals      map[string]string
+	Data      *webauthn.SessionData
+	FSM       *fsm.FSM
+	State     string
+}
+
+type APIKey struct {
 	ID       string `storm:"id"`
-	UserID   []byte
+	UserID   []byte `storm:"index"`
+	Name     string
+	Hash     string `storm:"unique"`
 	Created  time.Time
-	LastSeen time.Time
-	Expires  time.Time `storm:"index"`
-	Vals     map[string]string
-	Data     *webauthn.SessionData
-	FSM      *fsm.FSM
-	State    string
+	LastUsed time.Time
+	Expires  time.Time
+	Hosts    []string
+}
+
+// Expired reports whether the key has an expiry time that has passed
+func (k *APIKey) Expired() bool {
+	return !k.Expires.IsZero() && k.Expires.Before(time.Now())
+}
+
+// CanAccess reports whether the key is scoped to h, a key without hosts is valid for every host its user can access
+func (k *APIKey) CanAccess(h string) bool {
+	if len(k.Hosts) == 0 {
+		return true
+	}
+	return Contains(k.Hosts, h)
+}
+
+const (
+	HOST_POLICY_PRIVATE       = "private"
+	HOST_POLICY_AUTHENTICATED = "authenticated"
+	HOST_POLICY_PUBLIC        = "public"
+)
+
+// HostPolicies lists the default policies a host can have when no access rule matches
+var HostPolicies = []string{HOST_POLICY_PRIVATE, HOST_POLICY_AUTHENTICATED, HOST_POLICY_PUBLIC}
+
+// Host is a host tobab protects, hosts discovered through forward auth are pending until an admin accepts them
+type Host struct {
+	Name        string `storm:"id"`
+	DisplayName string
+	Description string
+	IconURL     string
+	Owner       string
+	Policy      string
+	Pending     bool
+	Created     time.Time
+	LastSeen    time.Time
+}
+
+// Title returns the display name of the host, or its name when it has none
+func (h *Host) Title() string {
+	if h.DisplayName != "" {
+		return h.DisplayName
+	}
+	return h.Name
+}
+
+const (
+	ACCESS_REQUEST_PENDING  = "pending"
+	ACCESS_REQUEST_APPROVED = "approved"
+	ACCESS_REQUEST_DENIED   = "denied"
+)
+
+// AccessRequest is a request of a user for access to a host, until an admin approves or denies it the status is pending
+type AccessRequest struct {
+	ID            string `storm:"id"`
+	UserID        []byte `storm:"index"`
+	UserName      string
+	Host          string
+	Justification string
+	Status        string `storm:"index"`
+	Created       time.Time
+	DecidedBy     string
+	Decided       time.Time
+	NotAfter      time.Time
+}
+
+// Pending reports whether no admin has decided on the request yet
+func (r *AccessRequest) Pending() bool {
+	return r.Status == ACCESS_REQUEST_PENDING
+}
+
+// Invite allows a single user to register when registration is invite only, the new user is given the hosts and groups of the invite
+type Invite struct {
+	ID        string `storm:"id"`
+	Hash      string `storm:"unique"`
+	Note      string
+	CreatedBy string
+	Created   time.Time
+	Expires   time.Time
+	Hosts     []string
+	Groups    []string
+}
+
+// Expired reports whether the invite has an expiry time that has passed
+func (inv *Invite) Expired() bool {
+	return !inv.Expires.IsZero() && inv.Expires.Before(time.Now())
+}
+
+// HashSecret returns the representation of a secret, such as an API key, that is stored in the database
+func HashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// OIDCClient is an application that uses tobab as its OpenID Connect provider
+type OIDCClient struct {
+	ID           string `storm:"id"`
+	Name         string
+	SecretHash   string
+	RedirectURIs []string
+	Host         string
+	Created      time.Time
+}
+
+// Public reports whether the client has no secret and has to use PKCE instead
+func (cl *OIDCClient) Public() bool {
+	return cl.SecretHash == ""
+}
+
+// AllowsRedirect reports whether uri exactly matches one of the registered redirect URIs
+func (cl *OIDCClient) AllowsRedirect(uri string) bool {
+	return Contains(cl.RedirectURIs, uri)
+}
+
+// SigningKey signs the identity tokens handed to upstreams, Key holds a PKCS #8 encoded private key
+type SigningKey struct {
+	ID      string
+	Created time.Time
+	Key     []byte
 }
 
 type Glob string
@@ -79,6 +379,82 @@ func (g Glob) Match(s string) bool {
 	return matcher.Glob(string(g), s)
 }
 
+const (
+	// POLICY_PUBLIC allows everyone, even visitors that are not logged in
+	POLICY_PUBLIC = "public"
+	// POLICY_AUTHENTICATED allows every logged in user
+	POLICY_AUTHENTICATED = "authenticated"
+	// POLICY_USERS only allows the users and members of the groups listed in the rule and admins
+	POLICY_USERS = "users"
+)
+
+// AccessRule overrides host based access for requests to Host that match Path and one of Methods
+type AccessRule struct {
+	ID       string `storm:"id"`
+	Host     string `storm:"index"`
+	Path     Glob
+	Methods  []string
+	Policy   string
+	Users    []string
+	Groups   []string
+	Priority int
+	Created  time.Time
+}
+
+// Matches reports whether a request is covered by this rule, a rule without methods matches every method
+func (r *AccessRule) Matches(host, path, method string) bool {
+	if r.Host != host || !r.Path.Match(cleanPath(path)) {
+		return false
+	}
+	return len(r.Methods) == 0 || Contains(r.Methods, method)
+}
+
+// cleanPath resolves the dot segments in p like the upstream will, so /public/../admin can't match a rule for /public/*.
+// A query or fragment is cut off first, dot segments in there don't change the path.
+func cleanPath(p string) string {
+	if i := strings.IndexAny(p, "?#"); i >= 0 {
+		p = p[:i]
+	}
+	clean := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && clean != "/" {
+		clean += "/"
+	}
+	return clean
+}
+
+// Allows reports whether user may make a request covered by this rule, user is nil for anonymous requests
+func (r *AccessRule) Allows(user *User) bool {
+	switch r.Policy {
+	case POLICY_PUBLIC:
+		return true
+	case POLICY_AUTHENTICATED:
+		return user != nil
+	case POLICY_USERS:
+		if user == nil {
+			return false
+		}
+		if user.Admin || Contains(r.Users, user.Name) {
+			return true
+		}
+		for _, g := range r.Groups {
+			if Contains(user.Groups, g) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// MatchAccessRule returns the first rule that matches the request, rules should be sorted by priority
+func MatchAccessRule(rules []AccessRule, host, path, method string) *AccessRule {
+	for i := range rules {
+		if rules[i].Matches(host, path, method) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
 func (c *Config) Validate() (bool, error) {
 	ok, err := govalidator.ValidateStruct(c)
 	if !ok {
@@ -115,3 +491,63 @@ func Contains(s []string, e string) bool {
 	}
 	return false
 }
+
+const (
+	AUDIT_REGISTRATION    = "registration"
+	AUDIT_LOGIN           = "login"
+	AUDIT_LOGIN_FAILED    = "login_failed"
+	AUDIT_LOGOUT          = "logout"
+	AUDIT_TOGGLE_ACCESS   = "toggle_access"
+	AUDIT_TOGGLE_ADMIN    = "toggle_admin"
+	AUDIT_GROUP_ACCESS    = "group_access"
+	AUDIT_GROUP_MEMBER    = "group_member"
+	AUDIT_VERIFY_DENIED   = "verify_denied"
+	AUDIT_PASSKEY_ADDED   = "passkey_added"
+	AUDIT_PASSKEY_DELETED = "passkey_deleted"
+	AUDIT_INVITE_CREATED  = "invite_created"
+	AUDIT_RECOVERY_LINK   = "recovery_link"
+	AUDIT_RECOVERY        = "recovery"
+	AUDIT_RECOVERY_START  = "recovery_started"
+	AUDIT_RECOVERY_FAILED = "recovery_failed"
+	AUDIT_ACCESS_REQUEST  = "access_request"
+	AUDIT_ACCESS_DECISION = "access_decision"
+	AUDIT_GRANT_EXPIRED   = "grant_expired"
+	AUDIT_HOST_CHANGED    = "host_changed"
+	AUDIT_SESSION_REVOKED = "session_revoked"
+	AUDIT_USER_DISABLED   = "user_disabled"
+	AUDIT_USER_DELETED    = "user_deleted"
+	AUDIT_FORCE_LOGOUT    = "force_logout"
+)
+
+// AuditTypes lists every type of audit event
+var AuditTypes = []string{
+	AUDIT_REGISTRATION, AUDIT_LOGIN, AUDIT_LOGIN_FAILED, AUDIT_LOGOUT,
+	AUDIT_TOGGLE_ACCESS, AUDIT_TOGGLE_ADMIN, AUDIT_GROUP_ACCESS, AUDIT_GROUP_MEMBER,
+	AUDIT_VERIFY_DENIED, AUDIT_PASSKEY_ADDED, AUDIT_PASSKEY_DELETED,
+	AUDIT_INVITE_CREATED, AUDIT_RECOVERY_LINK, AUDIT_RECOVERY,
+	AUDIT_RECOVERY_START, AUDIT_RECOVERY_FAILED,
+	AUDIT_ACCESS_REQUEST, AUDIT_ACCESS_DECISION, AUDIT_GRANT_EXPIRED,
+	AUDIT_HOST_CHANGED, AUDIT_SESSION_REVOKED, AUDIT_USER_DISABLED,
+	AUDIT_USER_DELETED, AUDIT_FORCE_LOGOUT,
+}
+
+// AuditEvent records a security relevant action, Actor is the user that performed it and Target the user or group it was performed on
+type AuditEvent struct {
+	ID     string    `storm:"id" json:"id"`
+	Time   time.Time `storm:"index" json:"time"`
+	Type   string    `storm:"index" json:"type"`
+	Actor  string    `json:"actor,omitempty"`
+	Target string    `json:"target,omitempty"`
+	Host   string    `json:"host,omitempty"`
+	IP     string    `json:"ip,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// AuditFilter selects audit events, empty fields match every event and User matches both the actor and the target
+type AuditFilter struct {
+	Type  string
+	User  string
+	Host  string
+	Since time.Time
+	Limit int
+}
@@ -0,0 +1,76 @@
+package tobab
+
+import "testing"
+
+func TestAccessRuleMatches(t *testing.T) {
+	tests := []struct {
+		name   string
+		rule   AccessRule
+		host   string
+		path   string
+		method string
+		want   bool
+	}{
+		{"exact path", AccessRule{Host: "a.example.com", Path: "/health"}, "a.example.com", "/health", "GET", true},
+		{"other host", AccessRule{Host: "a.example.com", Path: "/health"}, "b.example.com", "/health", "GET", false},
+		{"glob", AccessRule{Host: "a.example.com", Path: "/public/*"}, "a.example.com", "/public/css/main.css", "GET", true},
+		{"glob other path", AccessRule{Host: "a.example.com", Path: "/public/*"}, "a.example.com", "/admin/x", "GET", false},
+		{"no methods matches all", AccessRule{Host: "a.example.com", Path: "*"}, "a.example.com", "/", "DELETE", true},
+		{"listed method", AccessRule{Host: "a.example.com", Path: "*", Methods: []string{"GET", "HEAD"}}, "a.example.com", "/", "HEAD", true},
+		{"unlisted method", AccessRule{Host: "a.example.com", Path: "*", Methods: []string{"GET", "HEAD"}}, "a.example.com", "/", "POST", false},
+		{"traversal out of glob", AccessRule{Host: "a.example.com", Path: "/public/*"}, "a.example.com", "/public/../admin/x", "GET", false},
+		{"traversal to parent", AccessRule{Host: "a.example.com", Path: "/public/*"}, "a.example.com", "/public/..", "GET", false},
+		{"dot segments inside glob", AccessRule{Host: "a.example.com", Path: "/public/*"}, "a.example.com", "/public/./css/../main.css", "GET", true},
+		{"double slashes", AccessRule{Host: "a.example.com", Path: "/admin/*"}, "a.example.com", "//admin//x", "GET", true},
+		{"trailing slash kept", AccessRule{Host: "a.example.com", Path: "/docs/"}, "a.example.com", "/docs/", "GET", true},
+		{"traversal in query", AccessRule{Host: "a.example.com", Path: "/public/*"}, "a.example.com", "/admin/x?/../../public/x", "GET", false},
+		{"traversal in fragment", AccessRule{Host: "a.example.com", Path: "/public/*"}, "a.example.com", "/admin/x#/../../public/y", "GET", false},
+		{"traversal into rule", AccessRule{Host: "a.example.com", Path: "/admin/*"}, "a.example.com", "/public/../admin/x", "GET", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rule.Matches(tt.host, tt.path, tt.method); got != tt.want {
+				t.Errorf("Matches(%q, %q, %q) = %v, want %v", tt.host, tt.path, tt.method, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchAccessRule(t *testing.T) {
+	//sorted by priority, like the server does before matching
+	rules := []AccessRule{
+		{ID: "admin-post", Host: "a.example.com", Path: "/admin/*", Methods: []string{"POST"}, Policy: POLICY_USERS},
+		{ID: "admin", Host: "a.example.com", Path: "/admin/*", Policy: POLICY_AUTHENTICATED},
+		{ID: "public", Host: "a.example.com", Path: "/public/*", Policy: POLICY_PUBLIC},
+		{ID: "catch-all", Host: "a.example.com", Path: "*", Policy: POLICY_USERS},
+	}
+
+	tests := []struct {
+		name   string
+		host   string
+		path   string
+		method string
+		want   string
+	}{
+		{"first match wins", "a.example.com", "/admin/x", "POST", "admin-post"},
+		{"method falls through to next rule", "a.example.com", "/admin/x", "GET", "admin"},
+		{"public path", "a.example.com", "/public/index.html", "GET", "public"},
+		{"catch all", "a.example.com", "/", "GET", "catch-all"},
+		{"traversal from public", "a.example.com", "/public/../admin/x", "GET", "admin"},
+		{"decoded traversal from public", "a.example.com", "/public/./../admin/x", "POST", "admin-post"},
+		{"other host", "b.example.com", "/public/index.html", "GET", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ""
+			if r := MatchAccessRule(rules, tt.host, tt.path, tt.method); r != nil {
+				got = r.ID
+			}
+			if got != tt.want {
+				t.Errorf("MatchAccessRule(%q, %q, %q) = %q, want %q", tt.host, tt.path, tt.method, got, tt.want)
+			}
+		})
+	}
+}